@@ -0,0 +1,118 @@
+// Package awsid provides a machine id for Snooflake on Amazon EC2.
+package awsid
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+
+	"github.com/stringsinc/snooflake"
+	"github.com/stringsinc/snooflake/internal/imds"
+)
+
+// ErrNotEC2 is returned when the instance metadata service of Amazon EC2 is unreachable.
+var ErrNotEC2 = errors.New("not running on Amazon EC2")
+
+// metadataEndpoint is the base URL of the EC2 instance metadata service.
+var metadataEndpoint = "http://169.254.169.254/latest"
+
+// tokenTTL is the lifetime of an IMDSv2 session token in seconds.
+const tokenTTL = "60"
+
+// AmazonEC2MachineID returns the machine id of the Amazon EC2 instance,
+// to be used as Settings.MachineID.
+// The machine id is the lower 16 bits of the private IPv4 address of the instance.
+// If the instance has no private IPv4 address, the machine id is the instance id
+// hashed with snooflake.HashMachineID.
+//
+// The instance metadata is retrieved with an IMDSv2 session token,
+// falling back to IMDSv1 if the token is unavailable,
+// e.g. in a Docker container on an instance with the metadata hop limit of 1.
+// AmazonEC2MachineID returns ErrNotEC2, wrapped, as soon as a request fails to reach the metadata service,
+// except for the token request timing out, which happens beyond the hop limit too.
+func AmazonEC2MachineID() (uint16, error) {
+	token, err := metadataToken()
+	if err != nil {
+		return 0, fmt.Errorf("%w: %v", ErrNotEC2, err)
+	}
+
+	localIPv4, err := metadata(token, "meta-data/local-ipv4")
+	if unreachable(err) {
+		return 0, fmt.Errorf("%w: %v", ErrNotEC2, err)
+	}
+	if err == nil {
+		ip := net.ParseIP(localIPv4).To4()
+		if ip == nil {
+			return 0, fmt.Errorf("invalid private ip address %q", localIPv4)
+		}
+		return uint16(ip[2])<<8 + uint16(ip[3]), nil
+	}
+
+	instanceID, err := metadata(token, "meta-data/instance-id")
+	if unreachable(err) {
+		return 0, fmt.Errorf("%w: %v", ErrNotEC2, err)
+	}
+	if err != nil {
+		return 0, err
+	}
+	return snooflake.HashMachineID(instanceID), nil
+}
+
+// metadataToken returns an IMDSv2 session token, or "" if it is unavailable.
+// It returns an error only if the metadata service is unreachable other than by a timeout,
+// since the response to the token request is dropped beyond the hop limit.
+func metadataToken() (string, error) {
+	req, err := http.NewRequest(http.MethodPut, metadataEndpoint+"/api/token", nil)
+	if err != nil {
+		return "", nil
+	}
+	req.Header.Set("X-aws-ec2-metadata-token-ttl-seconds", tokenTTL)
+
+	body, err := do(req)
+	var netErr net.Error
+	if unreachable(err) && !(errors.As(err, &netErr) && netErr.Timeout()) {
+		return "", err
+	}
+	if err != nil {
+		return "", nil
+	}
+	return body, nil
+}
+
+func metadata(token, path string) (string, error) {
+	req, err := http.NewRequest(http.MethodGet, metadataEndpoint+"/"+path, nil)
+	if err != nil {
+		return "", err
+	}
+	if token != "" {
+		req.Header.Set("X-aws-ec2-metadata-token", token)
+	}
+	return do(req)
+}
+
+func do(req *http.Request) (string, error) {
+	res, err := imds.Client.Do(req)
+	if err != nil {
+		return "", err
+	}
+	defer res.Body.Close()
+
+	body, err := io.ReadAll(res.Body)
+	if err != nil {
+		return "", err
+	}
+	if res.StatusCode != http.StatusOK {
+		return "", fmt.Errorf("instance metadata %s: %s", req.URL.Path, res.Status)
+	}
+	return string(body), nil
+}
+
+// unreachable reports whether err is an error of the request rather than the response,
+// such as a refused connection.
+func unreachable(err error) bool {
+	var urlErr *url.Error
+	return errors.As(err, &urlErr)
+}
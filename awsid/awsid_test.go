@@ -0,0 +1,104 @@
+package awsid
+
+import (
+	"errors"
+	"net/http"
+	"testing"
+	"time"
+
+	"github.com/stringsinc/snooflake/internal/imdstest"
+)
+
+// fakeMetadata serves the instance metadata with the given values by path.
+// If tokenEnabled is false, it refuses to issue IMDSv2 tokens.
+// If requireToken is true, it rejects requests without the IMDSv2 token like HttpTokens=required.
+func fakeMetadata(t *testing.T, values map[string]string, tokenEnabled, requireToken bool) {
+	const token = "fake-token"
+
+	imdstest.Serve(t, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/latest/api/token" {
+			if !tokenEnabled || r.Method != http.MethodPut || r.Header.Get("X-aws-ec2-metadata-token-ttl-seconds") == "" {
+				http.Error(w, "forbidden", http.StatusForbidden)
+				return
+			}
+			w.Write([]byte(token))
+			return
+		}
+
+		if requireToken && r.Header.Get("X-aws-ec2-metadata-token") != token {
+			http.Error(w, "unauthorized", http.StatusUnauthorized)
+			return
+		}
+		v, ok := values[r.URL.Path]
+		if !ok {
+			http.NotFound(w, r)
+			return
+		}
+		w.Write([]byte(v))
+	}), &metadataEndpoint, "/latest")
+}
+
+func TestAmazonEC2MachineID(t *testing.T) {
+	values := map[string]string{
+		"/latest/meta-data/local-ipv4":  "172.31.18.52",
+		"/latest/meta-data/instance-id": "i-0123456789abcdef0",
+	}
+
+	testCases := []struct {
+		name                       string
+		tokenEnabled, requireToken bool
+	}{
+		{"IMDSv2", true, true},
+		{"IMDSv1", false, false},
+	}
+	for _, tc := range testCases {
+		fakeMetadata(t, values, tc.tokenEnabled, tc.requireToken)
+		id, err := AmazonEC2MachineID()
+		if err != nil || id != 18<<8+52 {
+			t.Errorf("unexpected machine id with %s: %d, %v", tc.name, id, err)
+		}
+	}
+}
+
+func TestAmazonEC2MachineIDFromInstanceID(t *testing.T) {
+	values := map[string]string{
+		"/latest/meta-data/instance-id": "i-0123456789abcdef0",
+	}
+	fakeMetadata(t, values, true, true)
+
+	id, err := AmazonEC2MachineID()
+	if err != nil || id != 0xd55c {
+		t.Errorf("unexpected machine id: %#x, %v", id, err)
+	}
+}
+
+func TestAmazonEC2MachineIDError(t *testing.T) {
+	values := map[string]string{
+		"/latest/meta-data/local-ipv4":  "172.31.18.52",
+		"/latest/meta-data/instance-id": "i-0123456789abcdef0",
+	}
+	fakeMetadata(t, values, false, true)
+	if _, err := AmazonEC2MachineID(); err == nil {
+		t.Error("machine id without token")
+	}
+
+	values["/latest/meta-data/local-ipv4"] = "fd00::1"
+	fakeMetadata(t, values, true, true)
+	if _, err := AmazonEC2MachineID(); err == nil {
+		t.Error("machine id from ipv6 address")
+	}
+}
+
+func TestAmazonEC2MachineIDNotEC2(t *testing.T) {
+	endpoint := metadataEndpoint
+	metadataEndpoint = "http://127.0.0.1:0"
+	defer func() { metadataEndpoint = endpoint }()
+
+	start := time.Now()
+	if _, err := AmazonEC2MachineID(); !errors.Is(err, ErrNotEC2) {
+		t.Errorf("unexpected error when unreachable: %v", err)
+	}
+	if elapsed := time.Since(start); elapsed > time.Second {
+		t.Errorf("unreachable metadata service not failed fast: %v", elapsed)
+	}
+}
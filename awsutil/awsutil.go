@@ -34,6 +34,8 @@ func amazonEC2PrivateIPv4() (net.IP, error) {
 // AmazonEC2MachineID retrieves the private IP address of the Amazon EC2 instance
 // and returns its lower 16 bits.
 // It works correctly on Docker as well.
+//
+// Deprecated: Use awsid.AmazonEC2MachineID, which supports IMDSv2.
 func AmazonEC2MachineID() (uint16, error) {
 	ip, err := amazonEC2PrivateIPv4()
 	if err != nil {
@@ -0,0 +1,58 @@
+// Package azureid provides a machine id for Snooflake on Azure Virtual Machines.
+package azureid
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"strings"
+
+	"github.com/stringsinc/snooflake"
+	"github.com/stringsinc/snooflake/internal/imds"
+)
+
+// ErrNotAzure is returned when the Azure Instance Metadata Service is unreachable
+// or does not serve the virtual machine id.
+var ErrNotAzure = errors.New("not running on Azure")
+
+// metadataEndpoint is the base URL of the Azure Instance Metadata Service.
+var metadataEndpoint = "http://169.254.169.254/metadata"
+
+const apiVersion = "2021-02-01"
+
+// MachineID returns the machine id of the Azure virtual machine, to be used as Settings.MachineID.
+// The machine id is the virtual machine id (vmId) hashed with snooflake.HashMachineID,
+// which is stable for the lifetime of the virtual machine.
+// Since different virtual machines may hash to the same machine id,
+// use Settings.CheckMachineID to validate its uniqueness.
+// MachineID returns ErrNotAzure, possibly wrapped, if not running on Azure.
+func MachineID() (uint16, error) {
+	url := metadataEndpoint + "/instance/compute/vmId?api-version=" + apiVersion + "&format=text"
+	req, err := http.NewRequest(http.MethodGet, url, nil)
+	if err != nil {
+		return 0, err
+	}
+	req.Header.Set("Metadata", "true")
+
+	res, err := imds.Client.Do(req)
+	if err != nil {
+		return 0, fmt.Errorf("%w: %v", ErrNotAzure, err)
+	}
+	defer res.Body.Close()
+
+	body, err := io.ReadAll(res.Body)
+	if err != nil {
+		return 0, err
+	}
+	// The metadata services of other clouds at the same address do not serve the path.
+	if res.StatusCode != http.StatusOK {
+		return 0, fmt.Errorf("%w: instance metadata %s: %s", ErrNotAzure, req.URL.Path, res.Status)
+	}
+
+	vmID := strings.TrimSpace(string(body))
+	if vmID == "" {
+		return 0, fmt.Errorf("%w: empty vmId", ErrNotAzure)
+	}
+	return snooflake.HashMachineID(vmID), nil
+}
@@ -0,0 +1,45 @@
+package azureid
+
+import (
+	"errors"
+	"net/http"
+	"testing"
+
+	"github.com/stringsinc/snooflake/internal/imdstest"
+)
+
+func fakeMetadata(t *testing.T, handler http.HandlerFunc) {
+	imdstest.Serve(t, handler, &metadataEndpoint, "/metadata")
+}
+
+func TestMachineID(t *testing.T) {
+	fakeMetadata(t, func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get("Metadata") != "true" {
+			http.Error(w, "missing header", http.StatusBadRequest)
+			return
+		}
+		if r.URL.Path != "/metadata/instance/compute/vmId" ||
+			r.URL.Query().Get("api-version") == "" || r.URL.Query().Get("format") != "text" {
+			http.NotFound(w, r)
+			return
+		}
+		w.Write([]byte("02aab8a4-74ef-476e-8182-f6d2ba4166a6"))
+	})
+
+	id, err := MachineID()
+	if err != nil || id != 0x5ade {
+		t.Errorf("unexpected machine id: %#x, %v", id, err)
+	}
+}
+
+func TestMachineIDNotAzure(t *testing.T) {
+	fakeMetadata(t, http.NotFound)
+	if _, err := MachineID(); !errors.Is(err, ErrNotAzure) {
+		t.Errorf("unexpected error for another cloud: %v", err)
+	}
+
+	metadataEndpoint = "http://127.0.0.1:0"
+	if _, err := MachineID(); !errors.Is(err, ErrNotAzure) {
+		t.Errorf("unexpected error when unreachable: %v", err)
+	}
+}
@@ -0,0 +1,77 @@
+package snooflake
+
+import (
+	"sync/atomic"
+	"time"
+)
+
+// NextIDAt generates a next unique ID whose time is t instead of the current time.
+// It is intended for backfilling IDs of historical data, such as migrated rows,
+// to preserve their rough time ordering.
+//
+// The IDs generated by NextIDAt are unique among each other and the IDs generated by NextID
+// as long as no other Snooflake with the same machine id generated IDs at t.
+// To guarantee it, t must be either before the creation of the Snooflake
+// or not before the time of the last ID generated by NextID.
+// Otherwise NextIDAt returns ErrTimeInUse.
+//
+// NextIDAt returns ErrTimeBeforeStart if t is before the start time,
+// ErrTimeAhead if t is ahead of the current time,
+// and ErrSequenceExhausted if all the sequence numbers of the time unit of t are used.
+// NextIDAt remembers the sequence numbers of every time unit before the creation of the Snooflake,
+// so backfilling a long time span needs memory proportional to the number of distinct time units.
+func (sf *Snooflake) NextIDAt(t time.Time) (uint64, error) {
+	elapsedTime := elapsedFromTime(sf.startTime, t, time.Duration(sf.timeUnit))
+	if elapsedTime < 0 {
+		return 0, ErrTimeBeforeStart
+	}
+	if t.After(sf.now()) {
+		return 0, ErrTimeAhead
+	}
+	if err := sf.usable(); err != nil {
+		return 0, err
+	}
+
+	if elapsedTime < sf.createdElapsedTime {
+		return sf.backfillID(elapsedTime)
+	}
+
+	maskSequence := uint16(1<<sf.bitLenSequence - 1)
+	for {
+		old := atomic.LoadUint64(&sf.state)
+		lastElapsedTime, sequence := unpackState(old)
+		switch {
+		case lastElapsedTime < elapsedTime:
+			sequence = 0
+		case lastElapsedTime == elapsedTime:
+			if sequence == maskSequence {
+				return 0, ErrSequenceExhausted
+			}
+			sequence++
+		default: // lastElapsedTime > elapsedTime
+			return 0, ErrTimeInUse
+		}
+
+		if atomic.CompareAndSwapUint64(&sf.state, old, packState(elapsedTime, sequence)) {
+			return sf.toID(elapsedTime, sequence)
+		}
+	}
+}
+
+func (sf *Snooflake) backfillID(elapsedTime int64) (uint64, error) {
+	sf.backfillMutex.Lock()
+	defer sf.backfillMutex.Unlock()
+
+	if sf.backfill == nil {
+		sf.backfill = make(map[int64]uint32)
+	}
+
+	// The count of used sequence numbers is the next sequence number.
+	// It is wider than uint16 to hold 1<<16 for the 16-bit sequence.
+	count := sf.backfill[elapsedTime]
+	if count >= 1<<sf.bitLenSequence {
+		return 0, ErrSequenceExhausted
+	}
+	sf.backfill[elapsedTime] = count + 1
+	return sf.toID(elapsedTime, uint16(count))
+}
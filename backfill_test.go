@@ -0,0 +1,65 @@
+package snooflake
+
+import (
+	"testing"
+	"time"
+)
+
+func TestNextIDAt(t *testing.T) {
+	startTime := time.Date(2020, 1, 1, 0, 0, 0, 0, time.UTC)
+	clock := &fakeClock{now: startTime.Add(time.Second)}
+
+	var st Settings
+	st.StartTime = startTime
+	st.NowFunc = clock.Now
+	st.Sleeper = clock.Add
+	st.MachineID = func() (uint16, error) { return 1, nil }
+	sf := NewSnooflake(st)
+
+	expectParts := func(id uint64, err error, elapsedTime, sequence uint64) {
+		t.Helper()
+		if err != nil {
+			t.Fatalf("id not generated: %v", err)
+		}
+		if parts := DecomposeParts(id); parts.Time != elapsedTime || parts.Sequence != sequence || parts.MachineID != 1 {
+			t.Errorf("unexpected parts: %+v", parts)
+		}
+	}
+
+	// Before the creation of the Snooflake
+	for i := uint64(0); i < 1<<BitLenSequence; i++ {
+		id, err := sf.NextIDAt(startTime.Add(500 * time.Millisecond))
+		expectParts(id, err, 500, i)
+	}
+	if _, err := sf.NextIDAt(startTime.Add(500 * time.Millisecond)); err != ErrSequenceExhausted {
+		t.Errorf("unexpected error: %v", err)
+	}
+	id, err := sf.NextIDAt(startTime)
+	expectParts(id, err, 0, 0)
+
+	// After the last ID
+	id, err = sf.NextIDAt(clock.Now())
+	expectParts(id, err, 1000, 0)
+	id, err = sf.NextID()
+	expectParts(id, err, 1000, 1)
+	id, err = sf.NextIDAt(clock.Now())
+	expectParts(id, err, 1000, 2)
+
+	clock.Add(10 * time.Millisecond)
+	id, err = sf.NextID()
+	expectParts(id, err, 1010, 0)
+
+	testCases := []struct {
+		t        time.Time
+		expected error
+	}{
+		{startTime.Add(-time.Millisecond), ErrTimeBeforeStart},
+		{clock.Now().Add(time.Millisecond), ErrTimeAhead},
+		{startTime.Add(1005 * time.Millisecond), ErrTimeInUse},
+	}
+	for _, tc := range testCases {
+		if _, err := sf.NextIDAt(tc.t); err != tc.expected {
+			t.Errorf("unexpected error for %v: %v", tc.t, err)
+		}
+	}
+}
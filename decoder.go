@@ -0,0 +1,96 @@
+package snooflake
+
+import (
+	"errors"
+	"fmt"
+	"sort"
+	"time"
+)
+
+// These errors are returned by Decoder.
+var (
+	ErrInvalidEpochs = errors.New("invalid epochs")
+	ErrNoEpoch       = errors.New("no epoch matches the id")
+)
+
+// Epoch is a start time of IDs, in effect for the IDs generated since ValidFrom
+// until the ValidFrom of the next Epoch.
+// With Settings.OnOverflow OverflowRecycle, a new epoch starts 1<<BitLenTime time units
+// after the previous one, when the time part wraps around, and is valid from its start time.
+// An epoch may also be rotated by hand, by restarting the generators with a new Settings.StartTime.
+type Epoch struct {
+	StartTime time.Time
+	ValidFrom time.Time
+}
+
+// Decoder decodes the time of IDs spanning several epochs, e.g. in a long-lived dataset,
+// given the approximate time at which each ID was ingested.
+//
+// An ID alone does not tell its epoch. Decoder tries the latest epoch valid at the ingestion time first,
+// and falls back to an earlier epoch if the decoded time is before the ValidFrom of the epoch
+// or after the ingestion time, since an ID cannot be ingested before it is generated.
+// This tells the epoch of an ID ingested less than an epoch length after its generation:
+// an ID generated just before a rotation and ingested just after it decodes to a time far ahead
+// in the new epoch, and to the right time in the previous one.
+// The choice is ambiguous for an ID ingested later than that, since its time in the previous epoch
+// is then also before the ingestion time, and wrong if the ingestion time is recorded by a clock
+// behind the clock of the generator; pass an ingestion time moved forward by the clock skew in that case.
+type Decoder struct {
+	layout Layout
+	epochs []Epoch
+}
+
+// NewDecoder returns a new Decoder of the IDs with the given layout in the given epochs.
+// The start time of the layout is ignored in favor of the start times of the epochs.
+// The epochs must be in ascending order of ValidFrom, or NewDecoder returns ErrInvalidEpochs, wrapped.
+// NewDecoder returns ErrInvalidBitLength or ErrInvalidFieldOrder for an invalid layout.
+func NewDecoder(layout Layout, epochs []Epoch) (*Decoder, error) {
+	if !layout.Bits.valid() {
+		return nil, ErrInvalidBitLength
+	}
+	if layout.Order != TimeSeqMachine && layout.Order != TimeMachineSeq {
+		return nil, ErrInvalidFieldOrder
+	}
+	if len(epochs) == 0 {
+		return nil, fmt.Errorf("%w: no epoch", ErrInvalidEpochs)
+	}
+	for i := 1; i < len(epochs); i++ {
+		if !epochs[i-1].ValidFrom.Before(epochs[i].ValidFrom) {
+			return nil, fmt.Errorf("%w: epoch %d is not valid after epoch %d", ErrInvalidEpochs, i, i-1)
+		}
+	}
+	if layout.TimeUnit == 0 {
+		layout.TimeUnit = snooflakeTimeUnit
+	}
+
+	return &Decoder{layout: layout, epochs: append([]Epoch(nil), epochs...)}, nil
+}
+
+// Epoch returns the epoch of id ingested at the given time as described in Decoder.
+// It returns ErrNoEpoch if no epoch matches, e.g. if the ingestion time is before the first epoch.
+func (d *Decoder) Epoch(id uint64, ingestedAt time.Time) (Epoch, error) {
+	_, e, err := d.decode(id, ingestedAt)
+	return e, err
+}
+
+// Time returns the time at which id ingested at the given time was generated, in UTC,
+// decoded with the epoch returned by Epoch.
+func (d *Decoder) Time(id uint64, ingestedAt time.Time) (time.Time, error) {
+	t, _, err := d.decode(id, ingestedAt)
+	return t, err
+}
+
+func (d *Decoder) decode(id uint64, ingestedAt time.Time) (time.Time, Epoch, error) {
+	// The epochs valid at the ingestion time are those before i.
+	i := sort.Search(len(d.epochs), func(i int) bool { return d.epochs[i].ValidFrom.After(ingestedAt) })
+	for i--; i >= 0; i-- {
+		layout := d.layout
+		layout.StartTime = d.epochs[i].StartTime
+		t := layout.Time(id)
+		// t is truncated to the time unit, which may begin before ValidFrom.
+		if t.Add(layout.TimeUnit).After(d.epochs[i].ValidFrom) && !t.After(ingestedAt) {
+			return t, d.epochs[i], nil
+		}
+	}
+	return time.Time{}, Epoch{}, ErrNoEpoch
+}
@@ -0,0 +1,81 @@
+package snooflake
+
+import (
+	"errors"
+	"testing"
+	"time"
+)
+
+func TestDecoder(t *testing.T) {
+	epochLength := (1 << BitLenTime) * time.Millisecond
+	start := time.Date(2000, 1, 1, 0, 0, 0, 0, time.UTC)
+	epochs := []Epoch{
+		{StartTime: start, ValidFrom: start},
+		{StartTime: start.Add(epochLength), ValidFrom: start.Add(epochLength)},
+		{StartTime: start.Add(2 * epochLength), ValidFrom: start.Add(2 * epochLength)},
+	}
+	d, err := NewDecoder(SnooflakeLayout, epochs)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	rotation := epochs[1].ValidFrom
+	testCases := []struct {
+		elapsedTime uint64
+		ingestedAt  time.Time
+		expected    time.Time
+		epoch       int
+	}{
+		// Generated just before the rotation and ingested just after it.
+		{1<<BitLenTime - 10, rotation.Add(time.Second), rotation.Add(-10 * time.Millisecond), 0},
+		// Generated and ingested just after the rotation.
+		{5, rotation.Add(time.Second), rotation.Add(5 * time.Millisecond), 1},
+		{5, rotation.Add(5 * time.Millisecond), rotation.Add(5 * time.Millisecond), 1},
+		// Ingested long after the generation, but within an epoch length.
+		{1000, rotation.Add(epochLength - time.Hour), rotation.Add(time.Second), 1},
+		{0, start.Add(time.Hour), start, 0},
+	}
+	for _, tc := range testCases {
+		id, err := SnooflakeLayout.Compose(tc.elapsedTime, 1, 2)
+		if err != nil {
+			t.Fatal(err)
+		}
+		actual, err := d.Time(id, tc.ingestedAt)
+		if err != nil || !actual.Equal(tc.expected) {
+			t.Errorf("unexpected time of %d ingested at %v: %v, %v", tc.elapsedTime, tc.ingestedAt, actual, err)
+		}
+		if e, err := d.Epoch(id, tc.ingestedAt); err != nil || e != epochs[tc.epoch] {
+			t.Errorf("unexpected epoch of %d ingested at %v: %+v, %v", tc.elapsedTime, tc.ingestedAt, e, err)
+		}
+	}
+
+	// An ID cannot be ingested before its generation or before the first epoch.
+	id, _ := SnooflakeLayout.Compose(1000, 0, 0)
+	if _, err := d.Time(id, start.Add(time.Millisecond)); err != ErrNoEpoch {
+		t.Errorf("unexpected error: %v", err)
+	}
+	if _, err := d.Time(id, start.Add(-time.Hour)); err != ErrNoEpoch {
+		t.Errorf("unexpected error: %v", err)
+	}
+}
+
+func TestNewDecoderError(t *testing.T) {
+	start := time.Date(2000, 1, 1, 0, 0, 0, 0, time.UTC)
+	unordered := []Epoch{{StartTime: start, ValidFrom: start}, {StartTime: start, ValidFrom: start}}
+	if _, err := NewDecoder(SnooflakeLayout, unordered); !errors.Is(err, ErrInvalidEpochs) {
+		t.Errorf("unexpected error: %v", err)
+	}
+	if _, err := NewDecoder(SnooflakeLayout, nil); !errors.Is(err, ErrInvalidEpochs) {
+		t.Errorf("unexpected error: %v", err)
+	}
+
+	epochs := []Epoch{{StartTime: start, ValidFrom: start}}
+	if _, err := NewDecoder(Layout{}, epochs); err != ErrInvalidBitLength {
+		t.Errorf("unexpected error: %v", err)
+	}
+	layout := SnooflakeLayout
+	layout.Order = -1
+	if _, err := NewDecoder(layout, epochs); err != ErrInvalidFieldOrder {
+		t.Errorf("unexpected error: %v", err)
+	}
+}
@@ -0,0 +1,153 @@
+package snooflake
+
+import (
+	"errors"
+	"fmt"
+	"math"
+	"strconv"
+	"strings"
+)
+
+// ErrInvalidBase62 is returned by DecodeBase62 when the string is not a base62-encoded Snooflake ID.
+var ErrInvalidBase62 = errors.New("invalid base62 string")
+
+// The base62 digits are in ASCII order so that encoded IDs sort like the IDs themselves.
+const base62Digits = "0123456789ABCDEFGHIJKLMNOPQRSTUVWXYZabcdefghijklmnopqrstuvwxyz"
+
+// base62Len is the number of base62 digits needed to encode any uint64.
+const base62Len = 11
+
+// EncodeBase62 returns the base62 encoding of id.
+// The result is always zero-padded to 11 characters,
+// so encoded IDs compare lexically in the same order as the IDs numerically.
+func EncodeBase62(id uint64) string {
+	var b [base62Len]byte
+	for i := base62Len - 1; i >= 0; i-- {
+		b[i] = base62Digits[id%62]
+		id /= 62
+	}
+	return string(b[:])
+}
+
+// DecodeBase62 returns the ID encoded in s by EncodeBase62.
+// Leading zeros may be omitted.
+// It returns ErrInvalidBase62 if s is empty, contains a non-base62 character or overflows uint64.
+func DecodeBase62(s string) (uint64, error) {
+	if len(s) == 0 || len(s) > base62Len {
+		return 0, ErrInvalidBase62
+	}
+
+	var id uint64
+	for i := 0; i < len(s); i++ {
+		d := base62Digit(s[i])
+		if d < 0 {
+			return 0, ErrInvalidBase62
+		}
+		if id > (math.MaxUint64-uint64(d))/62 {
+			return 0, ErrInvalidBase62
+		}
+		id = id*62 + uint64(d)
+	}
+	return id, nil
+}
+
+func base62Digit(c byte) int {
+	switch {
+	case '0' <= c && c <= '9':
+		return int(c - '0')
+	case 'A' <= c && c <= 'Z':
+		return int(c-'A') + 10
+	case 'a' <= c && c <= 'z':
+		return int(c-'a') + 36
+	}
+	return -1
+}
+
+// ErrInvalidCrockford is returned by DecodeCrockford when the string is not a Crockford base32-encoded Snooflake ID.
+var ErrInvalidCrockford = errors.New("invalid crockford base32 string")
+
+// The Crockford base32 digits omit I, L, O and U, which are easily misread.
+const crockfordDigits = "0123456789ABCDEFGHJKMNPQRSTVWXYZ"
+
+// crockfordLen is the number of Crockford base32 digits needed to encode any uint64.
+const crockfordLen = 13
+
+// EncodeCrockford returns the Crockford base32 encoding of id.
+// The result is always zero-padded to 13 characters,
+// so encoded IDs compare lexically in the same order as the IDs numerically.
+func EncodeCrockford(id uint64) string {
+	var b [crockfordLen]byte
+	for i := crockfordLen - 1; i >= 0; i-- {
+		b[i] = crockfordDigits[id&0x1f]
+		id >>= 5
+	}
+	return string(b[:])
+}
+
+// DecodeCrockford returns the ID encoded in s by EncodeCrockford.
+// Leading zeros may be omitted, lowercase letters are accepted,
+// and I and L are read as 1 and O as 0.
+// It returns ErrInvalidCrockford if s is empty, contains a non-Crockford character or overflows uint64.
+func DecodeCrockford(s string) (uint64, error) {
+	if len(s) == 0 || len(s) > crockfordLen {
+		return 0, ErrInvalidCrockford
+	}
+
+	var id uint64
+	for i := 0; i < len(s); i++ {
+		d := crockfordDigit(s[i])
+		if d < 0 {
+			return 0, ErrInvalidCrockford
+		}
+		if id>>59 != 0 {
+			return 0, ErrInvalidCrockford
+		}
+		id = id<<5 | uint64(d)
+	}
+	return id, nil
+}
+
+func crockfordDigit(c byte) int {
+	if 'a' <= c && c <= 'z' {
+		c -= 'a' - 'A'
+	}
+	switch c {
+	case 'I', 'L':
+		return 1
+	case 'O':
+		return 0
+	}
+	return strings.IndexByte(crockfordDigits, c)
+}
+
+// Parse parses a Snooflake ID in one of the following forms:
+// - base62 as encoded by EncodeBase62, if s is 11 characters long and contains a non-decimal character,
+// - hexadecimal with the prefix "0x" or "0X",
+// - decimal,
+// - base62 with the leading zeros omitted, if s contains a non-decimal character.
+// Note that a base62 string consisting only of decimal digits is parsed as decimal,
+// and that an encoded base62 string may itself begin with "0x",
+// so a hexadecimal string of 11 characters is parsed as base62; zero-pad it to 16 digits instead.
+// A strconv error is wrapped, and ErrInvalidID is returned if the MSB of the parsed ID is set.
+func Parse(s string) (uint64, error) {
+	var id uint64
+	var err error
+	switch {
+	case len(s) == base62Len && strings.Trim(s, "0123456789") != "":
+		id, err = DecodeBase62(s)
+	case strings.HasPrefix(s, "0x") || strings.HasPrefix(s, "0X"):
+		id, err = strconv.ParseUint(s[2:], 16, 64)
+	case strings.Trim(s, "0123456789") == "":
+		id, err = strconv.ParseUint(s, 10, 64)
+	default:
+		id, err = DecodeBase62(s)
+	}
+	if err != nil {
+		return 0, fmt.Errorf("parse id: %w", err)
+	}
+
+	if !IsValid(id) {
+		return 0, ErrInvalidID
+	}
+	return id, nil
+}
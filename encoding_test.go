@@ -0,0 +1,136 @@
+package snooflake
+
+import (
+	"errors"
+	"math"
+	"sort"
+	"strconv"
+	"testing"
+)
+
+func TestBase62(t *testing.T) {
+	ids := []uint64{0, 1, 61, 62, 1<<63 - 1, math.MaxUint64}
+	for _, id := range ids {
+		s := EncodeBase62(id)
+		if len(s) != base62Len {
+			t.Errorf("unexpected length of %q", s)
+		}
+		actual, err := DecodeBase62(s)
+		if err != nil || actual != id {
+			t.Errorf("unexpected round trip of %d: %d, %v", id, actual, err)
+		}
+	}
+
+	if id, err := DecodeBase62("z"); err != nil || id != 61 {
+		t.Errorf("unexpected unpadded decoding: %d, %v", id, err)
+	}
+}
+
+func TestBase62Order(t *testing.T) {
+	sf := NewSnooflake(Settings{MachineID: func() (uint16, error) { return 1, nil }})
+
+	var encoded []string
+	for i := 0; i < 1000; i++ {
+		id, err := sf.NextID()
+		if err != nil {
+			t.Fatal("id not generated")
+		}
+		encoded = append(encoded, EncodeBase62(id))
+	}
+	if !sort.StringsAreSorted(encoded) {
+		t.Errorf("encoded ids not sorted")
+	}
+}
+
+func TestDecodeBase62Error(t *testing.T) {
+	invalid := []string{"", "-", "0000000000+", "000000000000", "zzzzzzzzzzz"}
+	for _, s := range invalid {
+		if _, err := DecodeBase62(s); err != ErrInvalidBase62 {
+			t.Errorf("unexpected error for %q: %v", s, err)
+		}
+	}
+}
+
+func TestCrockford(t *testing.T) {
+	ids := []uint64{0, 1, 31, 32, 1<<63 - 1, math.MaxUint64}
+	for _, id := range ids {
+		s := EncodeCrockford(id)
+		if len(s) != crockfordLen {
+			t.Errorf("unexpected length of %q", s)
+		}
+		actual, err := DecodeCrockford(s)
+		if err != nil || actual != id {
+			t.Errorf("unexpected round trip of %d: %d, %v", id, actual, err)
+		}
+	}
+
+	if s := EncodeCrockford(math.MaxUint64); s != "FZZZZZZZZZZZZ" {
+		t.Errorf("unexpected encoding of max uint64: %q", s)
+	}
+
+	lenient := map[string]uint64{"z": 31, "1o": 32, "IL": 33, "il": 33, "0O0": 0, "abc": 10<<10 | 11<<5 | 12}
+	for s, expected := range lenient {
+		if id, err := DecodeCrockford(s); err != nil || id != expected {
+			t.Errorf("unexpected decoding of %q: %d, %v", s, id, err)
+		}
+	}
+}
+
+func TestCrockfordOrder(t *testing.T) {
+	sf := NewSnooflake(Settings{MachineID: func() (uint16, error) { return 1, nil }})
+
+	var encoded []string
+	for i := 0; i < 1000; i++ {
+		id, err := sf.NextID()
+		if err != nil {
+			t.Fatal("id not generated")
+		}
+		encoded = append(encoded, EncodeCrockford(id))
+	}
+	if !sort.StringsAreSorted(encoded) {
+		t.Errorf("encoded ids not sorted")
+	}
+}
+
+func TestDecodeCrockfordError(t *testing.T) {
+	invalid := []string{"", "-", "U", "000000000000+", "00000000000000", "G000000000000"}
+	for _, s := range invalid {
+		if _, err := DecodeCrockford(s); err != ErrInvalidCrockford {
+			t.Errorf("unexpected error for %q: %v", s, err)
+		}
+	}
+}
+
+func TestParse(t *testing.T) {
+	const id = 0x0123456789abcdef
+	valid := []string{"81985529216486895", "0x0123456789abcdef", "0X123456789ABCDEF", EncodeBase62(id)}
+	for _, s := range valid {
+		if actual, err := Parse(s); err != nil || actual != id {
+			t.Errorf("unexpected id from %q: %d, %v", s, actual, err)
+		}
+	}
+
+	var numErr *strconv.NumError
+	invalid := []string{"", "0x", "0xg", "18446744073709551616"}
+	for _, s := range invalid {
+		if _, err := Parse(s); !errors.As(err, &numErr) {
+			t.Errorf("unexpected error for %q: %v", s, err)
+		}
+	}
+
+	// EncodeBase62 returns strings beginning with "0x" for the IDs since about March 2016.
+	prefixed := uint64(59 * 62 * 62 * 62 * 62 * 62 * 62 * 62 * 62 * 62)
+	if s := EncodeBase62(prefixed); s != "0x000000000" {
+		t.Errorf("unexpected encoding: %s", s)
+	}
+	if actual, err := Parse("0x000000000"); err != nil || actual != prefixed {
+		t.Errorf("unexpected id from base62 beginning with 0x: %d, %v", actual, err)
+	}
+
+	if _, err := Parse("-1"); !errors.Is(err, ErrInvalidBase62) {
+		t.Errorf("unexpected error: %v", err)
+	}
+	if _, err := Parse("0x8000000000000000"); err != ErrInvalidID {
+		t.Errorf("unexpected error: %v", err)
+	}
+}
@@ -3,16 +3,17 @@ package main
 import (
 	"encoding/json"
 	"net/http"
+	"strconv"
 
-	"awsutil"
-	"snooflake"
+	"github.com/stringsinc/snooflake"
+	"github.com/stringsinc/snooflake/awsid"
 )
 
 var sf *snooflake.Snooflake
 
 func init() {
 	var st snooflake.Settings
-	st.MachineID = awsutil.AmazonEC2MachineID
+	st.MachineID = awsid.AmazonEC2MachineID
 	sf = snooflake.NewSnooflake(st)
 	if sf == nil {
 		panic("snooflake not created")
@@ -26,7 +27,30 @@ func handler(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	body, err := json.Marshal(snooflake.Decompose(id))
+	writeDecomposed(w, id)
+}
+
+func healthzHandler(w http.ResponseWriter, r *http.Request) {
+	if err := sf.Healthy(); err != nil {
+		http.Error(w, err.Error(), http.StatusServiceUnavailable)
+		return
+	}
+
+	w.Write([]byte("ok"))
+}
+
+func decomposeHandler(w http.ResponseWriter, r *http.Request) {
+	id, err := strconv.ParseUint(r.URL.Query().Get("id"), 10, 64)
+	if err != nil || !snooflake.IsValid(id) {
+		http.Error(w, "invalid id", http.StatusBadRequest)
+		return
+	}
+
+	writeDecomposed(w, id)
+}
+
+func writeDecomposed(w http.ResponseWriter, id uint64) {
+	body, err := json.Marshal(sf.DecomposeString(id))
 	if err != nil {
 		http.Error(w, err.Error(), http.StatusInternalServerError)
 		return
@@ -38,5 +62,7 @@ func handler(w http.ResponseWriter, r *http.Request) {
 
 func main() {
 	http.HandleFunc("/", handler)
+	http.HandleFunc("/decompose", decomposeHandler)
+	http.HandleFunc("/healthz", healthzHandler)
 	http.ListenAndServe(":8080", nil)
 }
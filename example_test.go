@@ -0,0 +1,32 @@
+package snooflake_test
+
+import (
+	"fmt"
+	"time"
+
+	"github.com/stringsinc/snooflake"
+)
+
+func ExampleNewDeterministic() {
+	startTime := time.Date(2020, 1, 1, 0, 0, 0, 0, time.UTC)
+	now := startTime.Add(time.Second)
+	clock := func() time.Time { return now }
+
+	sf, err := snooflake.NewDeterministic(startTime, 7, clock)
+	if err != nil {
+		panic(err)
+	}
+	for i := 0; i < 3; i++ {
+		id, _ := sf.NextID()
+		fmt.Println(snooflake.ID(id).Describe())
+	}
+
+	now = now.Add(time.Millisecond)
+	id, _ := sf.NextID()
+	fmt.Println(snooflake.ID(id).Describe())
+	// Output:
+	// 16777216007 (time=1000 seq=0 machine=7)
+	// 16777281543 (time=1000 seq=1 machine=7)
+	// 16777347079 (time=1000 seq=2 machine=7)
+	// 16793993223 (time=1001 seq=0 machine=7)
+}
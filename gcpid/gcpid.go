@@ -0,0 +1,53 @@
+// Package gcpid provides a machine id for Snooflake on Google Compute Engine.
+package gcpid
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"strings"
+
+	"github.com/stringsinc/snooflake"
+	"github.com/stringsinc/snooflake/internal/imds"
+)
+
+// ErrNotGCE is returned when the metadata server of Google Compute Engine is unreachable.
+var ErrNotGCE = errors.New("not running on Google Compute Engine")
+
+// metadataEndpoint is the base URL of the Compute Engine metadata server.
+var metadataEndpoint = "http://metadata.google.internal/computeMetadata/v1"
+
+// MachineID returns the machine id of the Compute Engine instance, to be used as Settings.MachineID.
+// The machine id is the numeric instance id hashed with snooflake.HashMachineID,
+// which is stable for the lifetime of the instance.
+// Since different instances may hash to the same machine id,
+// use Settings.CheckMachineID to validate its uniqueness.
+// MachineID returns ErrNotGCE, possibly wrapped, if not running on Compute Engine.
+func MachineID() (uint16, error) {
+	req, err := http.NewRequest(http.MethodGet, metadataEndpoint+"/instance/id", nil)
+	if err != nil {
+		return 0, err
+	}
+	req.Header.Set("Metadata-Flavor", "Google")
+
+	res, err := imds.Client.Do(req)
+	if err != nil {
+		return 0, fmt.Errorf("%w: %v", ErrNotGCE, err)
+	}
+	defer res.Body.Close()
+
+	// Only the genuine metadata server responds with the header.
+	if res.Header.Get("Metadata-Flavor") != "Google" {
+		return 0, ErrNotGCE
+	}
+
+	body, err := io.ReadAll(res.Body)
+	if err != nil {
+		return 0, err
+	}
+	if res.StatusCode != http.StatusOK {
+		return 0, fmt.Errorf("instance metadata %s: %s", req.URL.Path, res.Status)
+	}
+	return snooflake.HashMachineID(strings.TrimSpace(string(body))), nil
+}
@@ -0,0 +1,47 @@
+package gcpid
+
+import (
+	"errors"
+	"net/http"
+	"testing"
+
+	"github.com/stringsinc/snooflake/internal/imdstest"
+)
+
+func fakeMetadata(t *testing.T, handler http.HandlerFunc) {
+	imdstest.Serve(t, handler, &metadataEndpoint, "/computeMetadata/v1")
+}
+
+func TestMachineID(t *testing.T) {
+	fakeMetadata(t, func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Metadata-Flavor", "Google")
+		if r.Header.Get("Metadata-Flavor") != "Google" {
+			http.Error(w, "missing header", http.StatusForbidden)
+			return
+		}
+		if r.URL.Path != "/computeMetadata/v1/instance/id" {
+			http.NotFound(w, r)
+			return
+		}
+		w.Write([]byte("4567891234567891234"))
+	})
+
+	id, err := MachineID()
+	if err != nil || id != 0x1b6b {
+		t.Errorf("unexpected machine id: %#x, %v", id, err)
+	}
+}
+
+func TestMachineIDNotGCE(t *testing.T) {
+	fakeMetadata(t, func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte("4567891234567891234"))
+	})
+	if _, err := MachineID(); err != ErrNotGCE {
+		t.Errorf("unexpected error without the header: %v", err)
+	}
+
+	metadataEndpoint = "http://127.0.0.1:0"
+	if _, err := MachineID(); !errors.Is(err, ErrNotGCE) {
+		t.Errorf("unexpected error when unreachable: %v", err)
+	}
+}
@@ -0,0 +1,5 @@
+module github.com/stringsinc/snooflake
+
+go 1.18
+
+require github.com/deckarep/golang-set v1.8.0
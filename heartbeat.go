@@ -0,0 +1,31 @@
+package snooflake
+
+import (
+	"sync/atomic"
+	"time"
+)
+
+const defaultHeartbeatInterval = 10 * time.Second
+
+func (sf *Snooflake) startHeartbeat(heartbeat func(uint16) error, interval time.Duration) {
+	sf.stop = make(chan struct{})
+	sf.stopped = make(chan struct{})
+
+	go func() {
+		defer close(sf.stopped)
+
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-sf.stop:
+				return
+			case <-ticker.C:
+				if err := heartbeat(sf.machineID); err != nil {
+					atomic.StoreUint32(&sf.conflict, 1)
+					return
+				}
+			}
+		}
+	}()
+}
@@ -0,0 +1,252 @@
+package snooflake
+
+import (
+	"bytes"
+	"database/sql/driver"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"sort"
+	"strconv"
+)
+
+// ErrInvalidID is returned when a value is not a valid Snooflake ID, e.g. its MSB is set.
+var ErrInvalidID = errors.New("invalid id")
+
+// ID is a Snooflake ID with the default bit lengths.
+// Snooflake.NextTypedID generates IDs of this type.
+//
+// ID implements fmt.Stringer, json.Marshaler, encoding.TextMarshaler and driver.Valuer,
+// and their counterparts for decoding, all of which agree on the decimal representation of the ID.
+// The zero value is the ID 0, which is encoded as "0" and decoded back like any other ID;
+// use IsZero to tell an unset ID.
+//
+// ID implements driver.Valuer and sql.Scanner to be stored in a signed 64-bit integer column
+// such as bigint of PostgreSQL. Since the MSB of a valid ID is always 0,
+// the conversion between ID and int64 is lossless.
+type ID uint64
+
+// MSB returns the most significant bit of id, which is 0 for a valid Snooflake ID.
+func (id ID) MSB() uint64 {
+	return uint64(id) >> 63
+}
+
+// Time returns the time part of id in Snooflake time units.
+func (id ID) Time() uint64 {
+	return uint64(id) >> (BitLenSequence + BitLenMachineID)
+}
+
+// Sequence returns the sequence number part of id.
+func (id ID) Sequence() uint64 {
+	return uint64(id) >> BitLenMachineID & (1<<BitLenSequence - 1)
+}
+
+// MachineID returns the machine id part of id.
+func (id ID) MachineID() uint64 {
+	return uint64(id) & (1<<BitLenMachineID - 1)
+}
+
+// String returns id in decimal, which is the same as MarshalText and can be passed to Parse.
+func (id ID) String() string {
+	return strconv.FormatUint(uint64(id), 10)
+}
+
+// Describe returns id in decimal followed by its parts for debugging,
+// e.g. "81985529216486895 (time=4886718345 seq=171 machine=52719)".
+func (id ID) Describe() string {
+	return fmt.Sprintf("%d (time=%d seq=%d machine=%d)", uint64(id), id.Time(), id.Sequence(), id.MachineID())
+}
+
+// IsZero reports whether id is the zero value.
+func (id ID) IsZero() bool {
+	return id == 0
+}
+
+// Compare returns -1 if id is less than other, 0 if they are equal, and +1 otherwise.
+// Since the time is in the most significant bits, a smaller ID was generated earlier,
+// except for the IDs in the same time unit from different machines.
+// Compare compares the IDs as unsigned integers, whereas comparing them after a conversion
+// to int64 would order an invalid ID with the MSB set before all the others.
+func (id ID) Compare(other ID) int {
+	switch {
+	case id < other:
+		return -1
+	case id > other:
+		return +1
+	}
+	return 0
+}
+
+// SortIDs sorts ids in ascending order, which is the order of their generation time.
+func SortIDs(ids []uint64) {
+	sort.Slice(ids, func(i, j int) bool { return ids[i] < ids[j] })
+}
+
+// Before reports whether a was generated before b.
+// It compares the time parts, then the sequence numbers, and last the machine ids as a tiebreaker,
+// which gives a total order reflecting the generation order of the IDs of a single Snooflake.
+// Since the parts are laid out in that order from the most significant bit,
+// it is the same as a < b for the default bit lengths.
+func Before(a, b uint64) bool {
+	pa, pb := DecomposeParts(a), DecomposeParts(b)
+	if pa.Time != pb.Time {
+		return pa.Time < pb.Time
+	}
+	if pa.Sequence != pb.Sequence {
+		return pa.Sequence < pb.Sequence
+	}
+	return pa.MachineID < pb.MachineID
+}
+
+// Int64 returns id as int64, e.g. for an ORM mapping a bigint column to int64.
+// The conversion is lossless for a valid ID, whose MSB is 0.
+func (id ID) Int64() int64 {
+	return int64(id)
+}
+
+// FromInt64 returns the ID converted from v by ID.Int64.
+// It returns ErrInvalidID if v is negative, which means the MSB of the ID is set.
+func FromInt64(v int64) (ID, error) {
+	if v < 0 {
+		return 0, ErrInvalidID
+	}
+	return ID(v), nil
+}
+
+// Proto returns id as uint64 for a protobuf fixed64 field.
+// A fixed64 field is preferred to uint64 or int64, whose varint encoding takes 9 bytes
+// for a Snooflake ID with a recent time.
+// Since the MSB of a valid ID is 0, the value is also non-negative and ordered alike
+// when a downstream declares the field as sfixed64 and reads it as int64.
+func (id ID) Proto() uint64 {
+	return uint64(id)
+}
+
+// FromProto returns the ID of a protobuf fixed64 field, or of an sfixed64 field converted to uint64.
+// It returns ErrInvalidID if the MSB of the ID is set, e.g. for a negative sfixed64.
+func FromProto(v uint64) (ID, error) {
+	id := ID(v)
+	if id.MSB() != 0 {
+		return 0, ErrInvalidID
+	}
+	return id, nil
+}
+
+// uuidNamespace is the upper 64 bits of the UUID of an ID, "Snooflak" in ASCII.
+const uuidNamespace = 0x536e6f6f666c616b
+
+// UUIDString returns id as a UUID string for UUID-typed columns.
+// The upper 64 bits of the UUID are the fixed namespace 536e6f6f-666c-616b,
+// and the lower 64 bits are id in big endian,
+// e.g. "536e6f6f-666c-616b-0123-456789abcdef" for the ID 0x0123456789abcdef.
+// Since the namespace is constant, the UUIDs compare in the same order as the IDs,
+// both as strings and as 16 bytes. The UUID has no RFC 4122 version and variant bits.
+func (id ID) UUIDString() string {
+	return ID128{Hi: uuidNamespace, Lo: uint64(id)}.String()
+}
+
+// ParseUUID returns the ID whose UUID string is s, which is the inverse of ID.UUIDString.
+// Uppercase hexadecimal digits are accepted.
+// It returns ErrInvalidID if s is not a UUID string of the Snooflake namespace or the MSB of the ID is set.
+func ParseUUID(s string) (ID, error) {
+	u, err := ParseID128(s)
+	if err != nil || u.Hi != uuidNamespace {
+		return 0, ErrInvalidID
+	}
+
+	id := ID(u.Lo)
+	if id.MSB() != 0 {
+		return 0, ErrInvalidID
+	}
+	return id, nil
+}
+
+// Value implements driver.Valuer. It returns id as int64.
+// It returns ErrInvalidID if the MSB of id is set.
+func (id ID) Value() (driver.Value, error) {
+	if id.MSB() != 0 {
+		return nil, ErrInvalidID
+	}
+	return int64(id), nil
+}
+
+// Scan implements sql.Scanner. It accepts int64, and []byte or string in decimal.
+// It returns ErrInvalidID for a negative value.
+func (id *ID) Scan(src interface{}) error {
+	switch v := src.(type) {
+	case int64:
+		if v < 0 {
+			return ErrInvalidID
+		}
+		*id = ID(v)
+		return nil
+	case []byte:
+		return id.parse(string(v))
+	case string:
+		return id.parse(v)
+	}
+	return fmt.Errorf("cannot scan %T into ID", src)
+}
+
+func (id *ID) parse(s string) error {
+	v, err := strconv.ParseUint(s, 10, 63)
+	if err != nil {
+		return err
+	}
+	*id = ID(v)
+	return nil
+}
+
+// MarshalJSON implements json.Marshaler. It encodes id as a quoted decimal string.
+func (id ID) MarshalJSON() ([]byte, error) {
+	b := make([]byte, 0, 22)
+	b = append(b, '"')
+	b = strconv.AppendUint(b, uint64(id), 10)
+	b = append(b, '"')
+	return b, nil
+}
+
+// UnmarshalJSON implements json.Unmarshaler.
+// It accepts a quoted decimal string as well as a JSON number. A JSON null leaves id unchanged.
+func (id *ID) UnmarshalJSON(data []byte) error {
+	if len(data) >= 2 && data[0] == '"' && data[len(data)-1] == '"' {
+		data = data[1 : len(data)-1]
+	} else if bytes.Equal(data, []byte("null")) {
+		return nil
+	}
+	return id.parse(string(data))
+}
+
+// MarshalText implements encoding.TextMarshaler. It encodes id as a decimal string,
+// which is the same as the string in MarshalJSON without the quotes.
+func (id ID) MarshalText() ([]byte, error) {
+	return strconv.AppendUint(nil, uint64(id), 10), nil
+}
+
+// UnmarshalText implements encoding.TextUnmarshaler. It accepts a decimal string.
+func (id *ID) UnmarshalText(text []byte) error {
+	return id.parse(string(text))
+}
+
+// Bytes returns the big-endian encoding of id.
+// Since the time is in the most significant bits, comparing the encodings byte by byte,
+// e.g. as keys of a key-value store, orders IDs by time.
+func (id ID) Bytes() [8]byte {
+	var b [8]byte
+	binary.BigEndian.PutUint64(b[:], uint64(id))
+	return b
+}
+
+// FromBytes returns the ID encoded in b by ID.Bytes.
+// It returns ErrInvalidID if b is not 8 bytes long or the MSB of the ID is set.
+func FromBytes(b []byte) (ID, error) {
+	if len(b) != 8 {
+		return 0, ErrInvalidID
+	}
+
+	id := ID(binary.BigEndian.Uint64(b))
+	if id.MSB() != 0 {
+		return 0, ErrInvalidID
+	}
+	return id, nil
+}
@@ -0,0 +1,122 @@
+package snooflake
+
+import (
+	"encoding/binary"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"time"
+)
+
+// ErrObfuscatedID128 is returned by NextID128 if Settings.Obfuscate is set,
+// since Obfuscator permutes 64-bit IDs only.
+var ErrObfuscatedID128 = errors.New("ID128 cannot be obfuscated")
+
+// These constants are the bit lengths of ID128 parts.
+const (
+	BitLenTime128      = 64 // bit length of time
+	BitLenSequence128  = 16 // bit length of sequence number
+	BitLenMachineID128 = 48 // bit length of machine id
+)
+
+// ID128 is an extended 128-bit Snooflake ID for systems storing UUID-sized keys.
+// It is composed of
+//
+//	64 bits for time in Snooflake time units (Hi)
+//	16 bits for a sequence number (the upper bits of Lo)
+//	48 bits for a machine id (the lower bits of Lo)
+//
+// As with a 64-bit Snooflake ID, the parts are laid out from the most significant bit
+// so that comparing IDs by Hi and then Lo orders them by time.
+// The time never overflows, unlike the 39 bits of a 64-bit Snooflake ID.
+type ID128 struct {
+	Hi uint64
+	Lo uint64
+}
+
+// NextID128 generates a next unique ID128.
+// It shares the clock, the sequence and the machine id with NextID,
+// so the sequence numbers are limited to Settings.BitLenSequence bits per time unit
+// and the machine ids to 16 bits.
+// Settings.RandomizeSequenceStart and Settings.Trace apply as to NextID.
+// NextID128 returns the same errors as NextID except ErrOverTimeLimit,
+// and ErrObfuscatedID128 if Settings.Obfuscate is set.
+func (sf *Snooflake) NextID128() (ID128, error) {
+	if sf.obfuscator != nil {
+		return ID128{}, ErrObfuscatedID128
+	}
+
+	var start time.Time
+	if sf.trace != nil {
+		start = sf.now()
+	}
+	elapsedTime, sequence, _, slept, err := sf.reserve(1, true)
+	if sf.trace != nil {
+		sf.trace(sf.now().Sub(start), slept)
+	}
+	if err != nil {
+		return ID128{}, err
+	}
+	return ID128{
+		Hi: uint64(elapsedTime),
+		Lo: uint64(sf.sequenceAt(elapsedTime, sequence))<<BitLenMachineID128 | uint64(sf.machineID),
+	}, nil
+}
+
+// Time returns the time part of id in Snooflake time units.
+func (id ID128) Time() uint64 {
+	return id.Hi
+}
+
+// Sequence returns the sequence number part of id.
+func (id ID128) Sequence() uint64 {
+	return id.Lo >> BitLenMachineID128
+}
+
+// MachineID returns the machine id part of id.
+func (id ID128) MachineID() uint64 {
+	return id.Lo & (1<<BitLenMachineID128 - 1)
+}
+
+// Compare returns -1 if id is less than other, 0 if they are equal, and +1 otherwise.
+func (id ID128) Compare(other ID128) int {
+	switch {
+	case id.Hi < other.Hi || id.Hi == other.Hi && id.Lo < other.Lo:
+		return -1
+	case id == other:
+		return 0
+	}
+	return +1
+}
+
+// Bytes returns the big-endian encoding of id, which orders IDs by time when compared byte by byte.
+func (id ID128) Bytes() [16]byte {
+	var b [16]byte
+	binary.BigEndian.PutUint64(b[:8], id.Hi)
+	binary.BigEndian.PutUint64(b[8:], id.Lo)
+	return b
+}
+
+// String returns id in hexadecimal grouped like a UUID,
+// e.g. "00000001-2345-6789-00ab-0000cdef0123".
+// The string of an ID128 is not a valid RFC 4122 UUID since it has no version bits,
+// but it fits in a UUID column and sorts like the ID.
+func (id ID128) String() string {
+	b := id.Bytes()
+	return fmt.Sprintf("%x-%x-%x-%x-%x", b[0:4], b[4:6], b[6:8], b[8:10], b[10:16])
+}
+
+// ParseID128 parses the string of an ID128 returned by ID128.String.
+// It returns ErrInvalidID if s is not 32 hexadecimal digits grouped like a UUID.
+func ParseID128(s string) (ID128, error) {
+	if len(s) != 36 || s[8] != '-' || s[13] != '-' || s[18] != '-' || s[23] != '-' {
+		return ID128{}, ErrInvalidID
+	}
+
+	var b [16]byte
+	digits := s[0:8] + s[9:13] + s[14:18] + s[19:23] + s[24:36]
+	if _, err := hex.Decode(b[:], []byte(digits)); err != nil {
+		return ID128{}, ErrInvalidID
+	}
+	return ID128{Hi: binary.BigEndian.Uint64(b[:8]), Lo: binary.BigEndian.Uint64(b[8:])}, nil
+}
@@ -0,0 +1,103 @@
+package snooflake
+
+import (
+	"testing"
+	"time"
+)
+
+func TestNextID128(t *testing.T) {
+	sf, clock := newFakeClockSnooflake(t)
+	clock.Add(10 * time.Millisecond)
+
+	var last ID128
+	for i := 0; i < 1<<BitLenSequence; i++ {
+		id, err := sf.NextID128()
+		if err != nil {
+			t.Fatal("id not generated")
+		}
+		if id.Time() != 10 || id.Sequence() != uint64(i) || id.MachineID() != 1 {
+			t.Errorf("unexpected parts: %d, %d, %d", id.Time(), id.Sequence(), id.MachineID())
+		}
+		if i > 0 && id.Compare(last) != 1 {
+			t.Errorf("unexpected order: %v <= %v", id, last)
+		}
+		last = id
+	}
+
+	// The 128-bit ID has no time limit.
+	clock.Add((1 << BitLenTime) * time.Millisecond)
+	if _, err := sf.NextID(); err != ErrOverTimeLimit {
+		t.Errorf("unexpected error: %v", err)
+	}
+	id, err := sf.NextID128()
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if id.Time() != 10+1<<BitLenTime {
+		t.Errorf("unexpected time: %d", id.Time())
+	}
+}
+
+func TestNextID128Settings(t *testing.T) {
+	clock := &fakeClock{now: time.Date(2020, 1, 1, 0, 0, 0, 0, time.UTC)}
+	var st Settings
+	st.StartTime = clock.Now()
+	st.NowFunc = clock.Now
+	st.MachineID = func() (uint16, error) { return 1, nil }
+	st.RandomizeSequenceStart = true
+	var traced int
+	st.Trace = func(time.Duration, bool) { traced++ }
+	sf := NewSnooflake(st)
+
+	clock.Add(10 * time.Millisecond)
+	seen := make(map[uint64]bool)
+	for i := 0; i < 1<<BitLenSequence; i++ {
+		id, err := sf.NextID128()
+		if err != nil {
+			t.Fatal("id not generated")
+		}
+		if expected := uint64(sf.sequenceAt(10, uint16(i))); id.Sequence() != expected || seen[id.Sequence()] {
+			t.Errorf("unexpected sequence: %d", id.Sequence())
+		}
+		seen[id.Sequence()] = true
+	}
+	if traced != 1<<BitLenSequence {
+		t.Errorf("unexpected number of traces: %d", traced)
+	}
+
+	st.RandomizeSequenceStart = false
+	st.Obfuscate = NewObfuscator(42)
+	if _, err := NewSnooflake(st).NextID128(); err != ErrObfuscatedID128 {
+		t.Errorf("unexpected error: %v", err)
+	}
+}
+
+func TestID128String(t *testing.T) {
+	id := ID128{Hi: 0x0000000123456789, Lo: 0x00ab0000cdef0123}
+	s := id.String()
+	if s != "00000001-2345-6789-00ab-0000cdef0123" {
+		t.Errorf("unexpected string: %s", s)
+	}
+	if id.Sequence() != 0xab || id.MachineID() != 0xcdef0123 {
+		t.Errorf("unexpected parts: %d, %d", id.Sequence(), id.MachineID())
+	}
+
+	actual, err := ParseID128(s)
+	if err != nil || actual != id {
+		t.Errorf("unexpected round trip: %v, %v", actual, err)
+	}
+	if b := id.Bytes(); b[0] != 0 || b[7] != 0x89 || b[15] != 0x23 {
+		t.Errorf("unexpected bytes: %x", b)
+	}
+
+	if later := (ID128{Hi: id.Hi + 1}); later.String() <= s || later.Compare(id) != 1 || id.Compare(id) != 0 {
+		t.Errorf("unexpected order of %v and %v", later, id)
+	}
+
+	invalid := []string{"", "00000001234567890000000000000000", "00000001-2345-6789-00ab-0000cdef012g", "00000001-2345-6789-00ab-0000cdef01234"}
+	for _, s := range invalid {
+		if _, err := ParseID128(s); err != ErrInvalidID {
+			t.Errorf("unexpected error for %q: %v", s, err)
+		}
+	}
+}
@@ -0,0 +1,399 @@
+package snooflake
+
+import (
+	"bytes"
+	"database/sql"
+	"database/sql/driver"
+	"encoding"
+	"encoding/binary"
+	"encoding/json"
+	"fmt"
+	"strconv"
+	"strings"
+	"testing"
+)
+
+func TestIDParts(t *testing.T) {
+	ids := []uint64{0, 1, 1<<63 - 1, 1 << 63, 0x0123456789abcdef}
+	for _, v := range ids {
+		expected := Decompose(v)
+		actual := DecomposeParts(v)
+		if actual.ID != v ||
+			actual.MSB != expected["msb"] ||
+			actual.Time != expected["time"] ||
+			actual.Sequence != expected["sequence"] ||
+			actual.MachineID != expected["machine-id"] {
+			t.Errorf("unexpected parts of %d: %+v", v, actual)
+		}
+
+		id := ID(v)
+		if id.MSB() != actual.MSB ||
+			id.Time() != actual.Time ||
+			id.Sequence() != actual.Sequence ||
+			id.MachineID() != actual.MachineID {
+			t.Errorf("unexpected ID parts of %d", v)
+		}
+	}
+}
+
+func TestIDString(t *testing.T) {
+	testCases := []struct {
+		id       ID
+		expected string
+	}{
+		{0, "0 (time=0 seq=0 machine=0)"},
+		{0x0123456789abcdef, "81985529216486895 (time=4886718345 seq=171 machine=52719)"},
+		{1<<63 - 1, "9223372036854775807 (time=549755813887 seq=255 machine=65535)"},
+	}
+	for _, tc := range testCases {
+		if actual := tc.id.Describe(); actual != tc.expected {
+			t.Errorf("unexpected description of %d: %s", uint64(tc.id), actual)
+		}
+
+		decimal := strconv.FormatUint(uint64(tc.id), 10)
+		if actual := tc.id.String(); actual != decimal {
+			t.Errorf("unexpected string of %d: %s", uint64(tc.id), actual)
+		}
+		if actual := fmt.Sprint(tc.id); actual != decimal {
+			t.Errorf("unexpected formatted string of %d: %s", uint64(tc.id), actual)
+		}
+	}
+}
+
+func TestIDEncodingsAgree(t *testing.T) {
+	var _ fmt.Stringer = ID(0)
+	var _ json.Marshaler = ID(0)
+	var _ json.Unmarshaler = (*ID)(nil)
+	var _ sql.Scanner = (*ID)(nil)
+	var _ driver.Valuer = ID(0)
+
+	var zero ID
+	if !zero.IsZero() || ID(1).IsZero() {
+		t.Error("unexpected IsZero")
+	}
+
+	for _, id := range []ID{zero, 123, 1<<63 - 1} {
+		s := id.String()
+		text, _ := id.MarshalText()
+		b, _ := json.Marshal(id)
+		if string(text) != s || string(b) != strconv.Quote(s) {
+			t.Errorf("disagreeing encodings of %d: %s, %s, %s", uint64(id), s, text, b)
+		}
+
+		var parsed ID
+		if err := parsed.Scan(s); err != nil || parsed != id {
+			t.Errorf("unexpected scan of %s: %d, %v", s, parsed, err)
+		}
+		parsed = 1
+		if err := json.Unmarshal(b, &parsed); err != nil || parsed != id {
+			t.Errorf("unexpected json of %s: %d, %v", s, parsed, err)
+		}
+	}
+}
+
+func TestIDCompare(t *testing.T) {
+	testCases := []struct {
+		a, b     ID
+		expected int
+	}{
+		{0, 0, 0},
+		{1, 2, -1},
+		{2, 1, 1},
+		{1<<63 - 1, 1, 1},
+		{1 << 63, 1<<63 - 1, 1},
+	}
+	for _, tc := range testCases {
+		if actual := tc.a.Compare(tc.b); actual != tc.expected {
+			t.Errorf("unexpected comparison of %d and %d: %d", uint64(tc.a), uint64(tc.b), actual)
+		}
+	}
+}
+
+func TestSortIDs(t *testing.T) {
+	sf := NewSnooflake(Settings{MachineID: func() (uint16, error) { return 1, nil }})
+	expected, err := sf.NextIDs(100)
+	if err != nil {
+		t.Fatal("ids not generated")
+	}
+
+	ids := make([]uint64, len(expected))
+	copy(ids, expected)
+	for i := range ids {
+		j := (i*37 + 11) % len(ids)
+		ids[i], ids[j] = ids[j], ids[i]
+	}
+	SortIDs(ids)
+	if fmt.Sprint(ids) != fmt.Sprint(expected) {
+		t.Errorf("unexpected order: %v", ids)
+	}
+}
+
+func TestBefore(t *testing.T) {
+	compose := func(elapsedTime, sequence, machineID uint64) uint64 {
+		id, err := Compose(elapsedTime, sequence, machineID)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return id
+	}
+
+	testCases := []struct {
+		a, b     uint64
+		expected bool
+	}{
+		{compose(1, 0, 0), compose(2, 0, 0), true},
+		{compose(2, 0, 0), compose(1, 255, 65535), false},
+		{compose(1, 1, 5), compose(1, 2, 3), true},
+		{compose(1, 2, 3), compose(1, 1, 5), false},
+		{compose(1, 1, 3), compose(1, 1, 5), true},
+		{compose(1, 1, 5), compose(1, 1, 5), false},
+	}
+	for _, tc := range testCases {
+		if actual := Before(tc.a, tc.b); actual != tc.expected {
+			t.Errorf("unexpected order of %d and %d: %t", tc.a, tc.b, actual)
+		}
+	}
+
+	sf := NewSnooflake(Settings{MachineID: func() (uint16, error) { return 1, nil }})
+	ids, err := sf.NextIDs(1000)
+	if err != nil {
+		t.Fatal("ids not generated")
+	}
+	for i := 1; i < len(ids); i++ {
+		if !Before(ids[i-1], ids[i]) || Before(ids[i], ids[i-1]) {
+			t.Errorf("unexpected order of %d and %d", ids[i-1], ids[i])
+		}
+	}
+}
+
+func TestIDInt64(t *testing.T) {
+	for _, id := range []ID{0, 1, 0x0123456789abcdef, 1<<63 - 1} {
+		v := id.Int64()
+		if v < 0 || uint64(v) != uint64(id) {
+			t.Errorf("unexpected int64 of %d: %d", uint64(id), v)
+		}
+		if actual, err := FromInt64(v); err != nil || actual != id {
+			t.Errorf("unexpected round trip of %d: %d, %v", uint64(id), actual, err)
+		}
+	}
+
+	if _, err := FromInt64(-1); err != ErrInvalidID {
+		t.Errorf("unexpected error for negative value: %v", err)
+	}
+}
+
+func FuzzIDInt64(f *testing.F) {
+	for _, v := range []uint64{0, 1, 0x0123456789abcdef, 1<<63 - 1, 1 << 63, 1<<64 - 1} {
+		f.Add(v)
+	}
+	f.Fuzz(func(t *testing.T, v uint64) {
+		id := ID(v)
+		actual, err := FromInt64(id.Int64())
+		if id.MSB() != 0 {
+			if err != ErrInvalidID {
+				t.Errorf("unexpected error for %d: %v", v, err)
+			}
+			return
+		}
+		if err != nil || actual != id {
+			t.Errorf("unexpected round trip of %d: %d, %v", v, actual, err)
+		}
+	})
+}
+
+func TestIDProto(t *testing.T) {
+	sf := NewSnooflake(Settings{MachineID: func() (uint16, error) { return 1, nil }})
+	ids, err := sf.NextIDs(2)
+	if err != nil {
+		t.Fatal("ids not generated")
+	}
+
+	var signed []int64
+	for _, id := range []ID{ID(ids[0]), ID(ids[1]), 1<<63 - 1} {
+		// fixed64 and sfixed64 are both encoded in 8 bytes in little endian on the wire.
+		var wire [8]byte
+		binary.LittleEndian.PutUint64(wire[:], id.Proto())
+
+		v := int64(binary.LittleEndian.Uint64(wire[:]))
+		if v < 0 || uint64(v) != uint64(id) {
+			t.Errorf("unexpected sfixed64 of %d: %d", uint64(id), v)
+		}
+		signed = append(signed, v)
+
+		if actual, err := FromProto(uint64(v)); err != nil || actual != id {
+			t.Errorf("unexpected id from proto: %d, %v", actual, err)
+		}
+	}
+	if !(signed[0] < signed[1] && signed[1] < signed[2]) {
+		t.Errorf("sfixed64 not ordered like ids: %v", signed)
+	}
+
+	if _, err := FromProto(1 << 63); err != ErrInvalidID {
+		t.Errorf("unexpected error for negative sfixed64: %v", err)
+	}
+}
+
+func TestIDUUID(t *testing.T) {
+	id := ID(0x0123456789abcdef)
+	s := id.UUIDString()
+	if s != "536e6f6f-666c-616b-0123-456789abcdef" {
+		t.Errorf("unexpected uuid: %s", s)
+	}
+
+	for _, u := range []string{s, strings.ToUpper(s)} {
+		if actual, err := ParseUUID(u); err != nil || actual != id {
+			t.Errorf("unexpected id from %q: %d, %v", u, actual, err)
+		}
+	}
+
+	if (id+1).UUIDString() <= s || (id-0x100).UUIDString() >= s {
+		t.Errorf("uuids not ordered like ids")
+	}
+
+	invalid := []string{"", "00000000-0000-0000-0123-456789abcdef", "536e6f6f-666c-616b-8123-456789abcdef", "536e6f6f666c616b0123456789abcdef"}
+	for _, u := range invalid {
+		if _, err := ParseUUID(u); err != ErrInvalidID {
+			t.Errorf("unexpected error for %q: %v", u, err)
+		}
+	}
+}
+
+func TestIDValue(t *testing.T) {
+	ids := []ID{0, 1, 1<<63 - 1}
+	for _, id := range ids {
+		v, err := id.Value()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if v.(int64) < 0 || ID(v.(int64)) != id {
+			t.Errorf("unexpected value of %d: %d", id, v)
+		}
+
+		var scanned ID
+		if err := scanned.Scan(v); err != nil || scanned != id {
+			t.Errorf("unexpected round trip of %d: %d, %v", id, scanned, err)
+		}
+	}
+
+	if _, err := ID(1 << 63).Value(); err != ErrInvalidID {
+		t.Errorf("unexpected error: %v", err)
+	}
+}
+
+func TestIDScan(t *testing.T) {
+	valid := []interface{}{int64(123), []byte("123"), "123"}
+	for _, src := range valid {
+		var id ID
+		if err := id.Scan(src); err != nil || id != 123 {
+			t.Errorf("unexpected id from %T: %d, %v", src, id, err)
+		}
+	}
+
+	invalid := []interface{}{nil, int64(-1), "-1", "9223372036854775808", "abc", 1.5}
+	for _, src := range invalid {
+		var id ID
+		if err := id.Scan(src); err == nil {
+			t.Errorf("id from %v", src)
+		}
+	}
+}
+
+func TestIDJSON(t *testing.T) {
+	type entity struct {
+		ID ID `json:"id"`
+	}
+
+	maxID := entity{ID: 1<<63 - 1}
+	b, err := json.Marshal(maxID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(b) != `{"id":"9223372036854775807"}` {
+		t.Errorf("unexpected json: %s", b)
+	}
+
+	var actual entity
+	if err := json.Unmarshal(b, &actual); err != nil || actual != maxID {
+		t.Errorf("unexpected round trip: %d, %v", actual.ID, err)
+	}
+
+	if err := json.Unmarshal([]byte(`{"id":123}`), &actual); err != nil || actual.ID != 123 {
+		t.Errorf("unexpected id from number: %d, %v", actual.ID, err)
+	}
+
+	invalid := []string{`{"id":"abc"}`, `{"id":"-1"}`, `{"id":""}`, `{"id":"9223372036854775808"}`}
+	for _, s := range invalid {
+		if err := json.Unmarshal([]byte(s), &actual); err == nil {
+			t.Errorf("id from %s", s)
+		}
+	}
+}
+
+func TestIDText(t *testing.T) {
+	var _ encoding.TextMarshaler = ID(0)
+	var _ encoding.TextUnmarshaler = (*ID)(nil)
+
+	ids := []ID{0, 123, 1<<63 - 1}
+	for _, id := range ids {
+		text, err := id.MarshalText()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if expected := strconv.FormatUint(uint64(id), 10); string(text) != expected {
+			t.Errorf("unexpected text of %d: %s", uint64(id), text)
+		}
+
+		var actual ID
+		if err := actual.UnmarshalText(text); err != nil || actual != id {
+			t.Errorf("unexpected round trip of %d: %d, %v", uint64(id), uint64(actual), err)
+		}
+	}
+
+	// JSON encodes map keys with MarshalText.
+	b, err := json.Marshal(map[ID]string{123: "a"})
+	if err != nil || string(b) != `{"123":"a"}` {
+		t.Errorf("unexpected json: %s, %v", b, err)
+	}
+	var m map[ID]string
+	if err := json.Unmarshal(b, &m); err != nil || m[123] != "a" {
+		t.Errorf("unexpected map: %v, %v", m, err)
+	}
+
+	invalid := []string{"", "abc", "-1", `"123"`, "9223372036854775808"}
+	for _, s := range invalid {
+		var id ID
+		if err := id.UnmarshalText([]byte(s)); err == nil {
+			t.Errorf("id from %q", s)
+		}
+	}
+}
+
+func TestIDBytes(t *testing.T) {
+	sf := NewSnooflake(Settings{MachineID: func() (uint16, error) { return 1, nil }})
+
+	var last [8]byte
+	for i := 0; i < 1000; i++ {
+		id, err := sf.NextID()
+		if err != nil {
+			t.Fatal("id not generated")
+		}
+
+		b := ID(id).Bytes()
+		if bytes.Compare(b[:], last[:]) <= 0 {
+			t.Fatalf("bytes of %d not ordered", id)
+		}
+		last = b
+
+		actual, err := FromBytes(b[:])
+		if err != nil || actual != ID(id) {
+			t.Errorf("unexpected round trip of %d: %d, %v", id, actual, err)
+		}
+	}
+
+	invalid := [][]byte{nil, make([]byte, 7), make([]byte, 9), {0x80, 0, 0, 0, 0, 0, 0, 0}}
+	for _, b := range invalid {
+		if _, err := FromBytes(b); err != ErrInvalidID {
+			t.Errorf("unexpected error for %x: %v", b, err)
+		}
+	}
+}
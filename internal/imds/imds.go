@@ -0,0 +1,12 @@
+// Package imds holds what the machine id packages for the clouds share
+// to query the instance metadata services.
+package imds
+
+import (
+	"net/http"
+	"time"
+)
+
+// Client times out quickly since the instance metadata services are local,
+// and unreachable outside their clouds.
+var Client = &http.Client{Timeout: 2 * time.Second}
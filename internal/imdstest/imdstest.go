@@ -0,0 +1,19 @@
+// Package imdstest fakes the instance metadata services in the tests of the cloud packages.
+package imdstest
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+// Serve serves handler in place of the metadata service until the end of the test.
+// It points *endpoint at the given path of the fake server, and restores it on cleanup.
+func Serve(t *testing.T, handler http.Handler, endpoint *string, path string) {
+	server := httptest.NewServer(handler)
+	t.Cleanup(server.Close)
+
+	prev := *endpoint
+	*endpoint = server.URL + path
+	t.Cleanup(func() { *endpoint = prev })
+}
@@ -0,0 +1,214 @@
+package snooflake
+
+import (
+	"errors"
+	"time"
+)
+
+// These errors are returned by GuessStartTime.
+var (
+	ErrNoIDs                = errors.New("no ids")
+	ErrImplausibleStartTime = errors.New("implausible start time")
+)
+
+// FieldOrder is the order of the parts of an ID from the most significant bit.
+type FieldOrder int
+
+// These are the orders of the parts of an ID.
+const (
+	TimeSeqMachine FieldOrder = iota // time, sequence number, machine id
+	TimeMachineSeq                   // time, machine id, sequence number
+)
+
+// BitLayout is the bit lengths of the parts of an ID in the order of
+// the time, the sequence number and the machine id from the most significant bit.
+// The bit lengths of a valid BitLayout sum to 63, leaving the MSB 0.
+type BitLayout struct {
+	Time      uint8
+	Sequence  uint8
+	MachineID uint8
+}
+
+// DefaultLayout is the BitLayout of a Snooflake with the default Settings.
+var DefaultLayout = BitLayout{Time: BitLenTime, Sequence: BitLenSequence, MachineID: BitLenMachineID}
+
+// NewBitLayout returns the BitLayout with the given bit lengths of the time,
+// the sequence number and the machine id.
+// It returns ErrInvalidBitLength if the bit lengths do not sum to 63.
+func NewBitLayout(bitLenTime, bitLenSequence, bitLenMachineID uint8) (BitLayout, error) {
+	b := BitLayout{Time: bitLenTime, Sequence: bitLenSequence, MachineID: bitLenMachineID}
+	if !b.valid() {
+		return BitLayout{}, ErrInvalidBitLength
+	}
+	return b, nil
+}
+
+func (b BitLayout) valid() bool {
+	return int(b.Time)+int(b.Sequence)+int(b.MachineID) == 63
+}
+
+// Compose returns the ID with the given parts in the layout, which is the inverse of Decompose.
+// It returns ErrInvalidBitLength if b is invalid, and ErrOverTimeLimit, ErrSequenceTooLarge
+// or ErrMachineIDTooLarge if a part does not fit in its bits.
+func (b BitLayout) Compose(elapsedTime, sequence, machineID uint64) (uint64, error) {
+	if !b.valid() {
+		return 0, ErrInvalidBitLength
+	}
+	if elapsedTime >= 1<<b.Time {
+		return 0, ErrOverTimeLimit
+	}
+	if sequence >= 1<<b.Sequence {
+		return 0, ErrSequenceTooLarge
+	}
+	if machineID >= 1<<b.MachineID {
+		return 0, ErrMachineIDTooLarge
+	}
+	return elapsedTime<<(b.Sequence+b.MachineID) | sequence<<b.MachineID | machineID, nil
+}
+
+// Decompose returns the parts of an ID in the layout. b must be valid.
+func (b BitLayout) Decompose(id uint64) Parts {
+	return decomposeParts(id, b.Sequence, b.MachineID)
+}
+
+// Masks returns the bit masks of the time, the sequence number and the machine id
+// in the layout, which are TimeMask, SequenceMask and MachineIDMask for the DefaultLayout.
+// b must be valid.
+func (b BitLayout) Masks() (timeMask, sequenceMask, machineIDMask uint64) {
+	return masks(b.Time, b.Sequence, b.MachineID)
+}
+
+// Layout describes the bit lengths, the order of the parts and the epoch of IDs.
+// It decodes IDs without a Snooflake generating them.
+type Layout struct {
+	Bits      BitLayout
+	Order     FieldOrder
+	StartTime time.Time
+	TimeUnit  time.Duration
+}
+
+// These are the layouts of well-known ID generators.
+var (
+	// SnooflakeLayout is the layout of a Snooflake with the default Settings
+	// and the initial DefaultStartTime.
+	SnooflakeLayout = Layout{
+		Bits:      DefaultLayout,
+		Order:     TimeSeqMachine,
+		StartTime: DefaultStartTime,
+		TimeUnit:  time.Millisecond,
+	}
+
+	// SonyflakeLayout is the layout of Sonyflake, which uses a time unit of 10 msec.
+	SonyflakeLayout = Layout{
+		Bits:      BitLayout{Time: 39, Sequence: 8, MachineID: 16},
+		Order:     TimeSeqMachine,
+		StartTime: time.Date(2014, 9, 1, 0, 0, 0, 0, time.UTC),
+		TimeUnit:  10 * time.Millisecond,
+	}
+
+	// SnowflakeLayout is the layout of Twitter's Snowflake,
+	// whose 10-bit machine id consists of a datacenter id and a worker id.
+	SnowflakeLayout = Layout{
+		Bits:      BitLayout{Time: 41, Sequence: 12, MachineID: 10},
+		Order:     TimeMachineSeq,
+		StartTime: time.Unix(0, 1288834974657*int64(time.Millisecond)).UTC(),
+		TimeUnit:  time.Millisecond,
+	}
+)
+
+// DecomposeWith returns the parts of an ID with the given layout.
+// It is layout.Bits.Decompose(id) unless layout.Order is TimeMachineSeq.
+func DecomposeWith(id uint64, layout Layout) Parts {
+	if layout.Order == TimeMachineSeq {
+		// Decompose the machine id as if it were the sequence number, and vice versa.
+		p := decomposeParts(id, layout.Bits.MachineID, layout.Bits.Sequence)
+		p.Sequence, p.MachineID = p.MachineID, p.Sequence
+		return p
+	}
+	return layout.Bits.Decompose(id)
+}
+
+// Compose returns the ID with the given parts in the layout, which is the inverse of DecomposeWith.
+// It returns the errors of BitLayout.Compose, and ErrInvalidFieldOrder if layout.Order is invalid.
+func (layout Layout) Compose(elapsedTime, sequence, machineID uint64) (uint64, error) {
+	switch layout.Order {
+	case TimeSeqMachine:
+		return layout.Bits.Compose(elapsedTime, sequence, machineID)
+	case TimeMachineSeq:
+		swapped := BitLayout{Time: layout.Bits.Time, Sequence: layout.Bits.MachineID, MachineID: layout.Bits.Sequence}
+		id, err := swapped.Compose(elapsedTime, machineID, sequence)
+		switch err {
+		case ErrSequenceTooLarge:
+			err = ErrMachineIDTooLarge
+		case ErrMachineIDTooLarge:
+			err = ErrSequenceTooLarge
+		}
+		return id, err
+	}
+	return 0, ErrInvalidFieldOrder
+}
+
+// Time returns the time at which the ID with the layout was generated, in UTC.
+// If layout.TimeUnit is 0, the default time unit of 1 msec is used.
+func (layout Layout) Time(id uint64) time.Time {
+	return TimeFromElapsed(layout.StartTime, DecomposeWith(id, layout).Time, layout.TimeUnit)
+}
+
+// GuessStartTime estimates the start time of unknown IDs with the given bit layout,
+// e.g. to reverse-engineer the epoch of a service during incident response.
+// It assumes that the IDs are recent, so that the newest of them was generated roughly now,
+// and that the time unit is the default of 1 msec. The estimate is later than
+// the true start time by the age of the newest ID and is truncated to the time unit.
+//
+// GuessStartTime returns ErrNoIDs if ids is empty, ErrInvalidBitLength if the layout is invalid,
+// ErrInvalidID if an ID has the MSB set, and ErrImplausibleStartTime if the estimate
+// is not before now or before the Unix epoch, which means that the assumptions do not hold.
+func GuessStartTime(ids []uint64, assumeLayout BitLayout) (time.Time, error) {
+	return guessStartTime(ids, assumeLayout, time.Now())
+}
+
+func guessStartTime(ids []uint64, layout BitLayout, now time.Time) (time.Time, error) {
+	if len(ids) == 0 {
+		return time.Time{}, ErrNoIDs
+	}
+	if !layout.valid() {
+		return time.Time{}, ErrInvalidBitLength
+	}
+
+	var maxTime uint64
+	for _, id := range ids {
+		parts := layout.Decompose(id)
+		if parts.MSB != 0 {
+			return time.Time{}, ErrInvalidID
+		}
+		if parts.Time > maxTime {
+			maxTime = parts.Time
+		}
+	}
+
+	current := toSnooflakeTime(now, snooflakeTimeUnit)
+	if maxTime == 0 || maxTime > uint64(current) {
+		return time.Time{}, ErrImplausibleStartTime
+	}
+	return time.Unix(0, (current-int64(maxTime))*snooflakeTimeUnit).UTC(), nil
+}
+
+// MachineIDs returns how many of ids each machine generated, e.g. to audit which nodes
+// contributed to a dataset. It assumes the DefaultLayout; see BitLayout.MachineIDs for other layouts.
+func MachineIDs(ids []uint64) map[uint16]int {
+	counts := make(map[uint16]int)
+	for _, id := range ids {
+		counts[uint16(id&MachineIDMask)]++
+	}
+	return counts
+}
+
+// MachineIDs returns how many of ids with the layout each machine generated. b must be valid.
+// The machine ids are not truncated, since the machine id part of b may be wider than 16 bits.
+func (b BitLayout) MachineIDs(ids []uint64) map[uint64]int {
+	counts := make(map[uint64]int)
+	for _, id := range ids {
+		counts[b.Decompose(id).MachineID]++
+	}
+	return counts
+}
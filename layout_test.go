@@ -0,0 +1,232 @@
+package snooflake
+
+import (
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestDecomposeWith(t *testing.T) {
+	id := uint64(0x0123456789abcdef)
+	if actual := DecomposeWith(id, SnooflakeLayout); actual != DecomposeParts(id) {
+		t.Errorf("unexpected snooflake parts: %+v", actual)
+	}
+
+	sonyflakeID := uint64(1234)<<24 | uint64(5)<<16 | 6
+	expected := Parts{ID: sonyflakeID, Time: 1234, Sequence: 5, MachineID: 6}
+	if actual := DecomposeWith(sonyflakeID, SonyflakeLayout); actual != expected {
+		t.Errorf("unexpected sonyflake parts: %+v", actual)
+	}
+	expectedTime := time.Date(2014, 9, 1, 0, 0, 12, 340000000, time.UTC)
+	if actual := SonyflakeLayout.Time(sonyflakeID); !actual.Equal(expectedTime) {
+		t.Errorf("unexpected sonyflake time: %v", actual)
+	}
+
+	snowflakeID := uint64(1212092628029698048)
+	expected = Parts{ID: snowflakeID, Time: 288985402114, Sequence: 0, MachineID: 327}
+	if actual := DecomposeWith(snowflakeID, SnowflakeLayout); actual != expected {
+		t.Errorf("unexpected snowflake parts: %+v", actual)
+	}
+	expectedTime = time.Date(2019, 12, 31, 19, 26, 16, 771000000, time.UTC)
+	if actual := SnowflakeLayout.Time(snowflakeID); !actual.Equal(expectedTime) {
+		t.Errorf("unexpected snowflake time: %v", actual)
+	}
+
+	snowflakeID = uint64(100)<<22 | uint64(0x3ff)<<12 | 7
+	expected = Parts{ID: snowflakeID, Time: 100, Sequence: 7, MachineID: 0x3ff}
+	if actual := DecomposeWith(snowflakeID, SnowflakeLayout); actual != expected {
+		t.Errorf("unexpected snowflake parts: %+v", actual)
+	}
+}
+
+func TestLayoutCompose(t *testing.T) {
+	for _, layout := range []Layout{SnooflakeLayout, SnowflakeLayout} {
+		id, err := layout.Compose(100, 7, 0x3ff)
+		if err != nil {
+			t.Fatal(err)
+		}
+		expected := Parts{ID: id, Time: 100, Sequence: 7, MachineID: 0x3ff}
+		if actual := DecomposeWith(id, layout); actual != expected {
+			t.Errorf("unexpected round trip in order %d: %+v", layout.Order, actual)
+		}
+
+		maxSequence := uint64(1)<<layout.Bits.Sequence - 1
+		if _, err := layout.Compose(0, maxSequence+1, 0); err != ErrSequenceTooLarge {
+			t.Errorf("unexpected error for sequence in order %d: %v", layout.Order, err)
+		}
+		maxMachineID := uint64(1)<<layout.Bits.MachineID - 1
+		if _, err := layout.Compose(0, 0, maxMachineID+1); err != ErrMachineIDTooLarge {
+			t.Errorf("unexpected error for machine id in order %d: %v", layout.Order, err)
+		}
+	}
+
+	if id, _ := SnowflakeLayout.Compose(100, 7, 0x3ff); id != uint64(100)<<22|uint64(0x3ff)<<12|7 {
+		t.Errorf("unexpected snowflake id: %d", id)
+	}
+
+	invalid := SnooflakeLayout
+	invalid.Order = TimeMachineSeq + 1
+	if _, err := invalid.Compose(0, 0, 0); err != ErrInvalidFieldOrder {
+		t.Errorf("unexpected error for invalid order: %v", err)
+	}
+}
+
+func TestBitLayout(t *testing.T) {
+	if DefaultLayout != (BitLayout{Time: 39, Sequence: 8, MachineID: 16}) {
+		t.Errorf("unexpected default layout: %+v", DefaultLayout)
+	}
+	if SonyflakeLayout.Bits != DefaultLayout || SnowflakeLayout.Bits == DefaultLayout {
+		t.Error("unexpected layouts of well-known IDs")
+	}
+
+	b, err := NewBitLayout(41, 12, 10)
+	if err != nil || b != SnowflakeLayout.Bits {
+		t.Errorf("unexpected layout: %+v, %v", b, err)
+	}
+	invalid := [][3]uint8{{0, 0, 0}, {39, 8, 8}, {41, 12, 11}, {255, 8, 56}}
+	for _, v := range invalid {
+		if _, err := NewBitLayout(v[0], v[1], v[2]); err != ErrInvalidBitLength {
+			t.Errorf("unexpected error for %v: %v", v, err)
+		}
+	}
+
+	id, err := b.Compose(100, 7, 0x3ff)
+	if err != nil || id != uint64(100)<<22|uint64(7)<<10|0x3ff {
+		t.Errorf("unexpected id: %d, %v", id, err)
+	}
+	expected := Parts{ID: id, Time: 100, Sequence: 7, MachineID: 0x3ff}
+	if actual := b.Decompose(id); actual != expected {
+		t.Errorf("unexpected parts: %+v", actual)
+	}
+
+	testCases := []struct {
+		layout                           BitLayout
+		elapsedTime, sequence, machineID uint64
+		expected                         error
+	}{
+		{BitLayout{}, 0, 0, 0, ErrInvalidBitLength},
+		{b, 1 << 41, 0, 0, ErrOverTimeLimit},
+		{b, 0, 1 << 12, 0, ErrSequenceTooLarge},
+		{b, 0, 0, 1 << 10, ErrMachineIDTooLarge},
+	}
+	for _, tc := range testCases {
+		if _, err := tc.layout.Compose(tc.elapsedTime, tc.sequence, tc.machineID); err != tc.expected {
+			t.Errorf("unexpected error for %+v: %v", tc, err)
+		}
+	}
+}
+
+func TestGuessStartTime(t *testing.T) {
+	now := time.Date(2020, 1, 1, 0, 0, 0, 0, time.UTC)
+	ids := []uint64{
+		uint64(1000)<<24 | 1,
+		uint64(5000)<<24 | 2,
+		uint64(3000)<<24 | 3,
+	}
+	startTime, err := guessStartTime(ids, DefaultLayout, now)
+	if err != nil || !startTime.Equal(now.Add(-5*time.Second)) {
+		t.Errorf("unexpected start time: %v, %v", startTime, err)
+	}
+
+	snowflakeID := uint64(1212092628029698048)
+	now = time.Date(2019, 12, 31, 19, 26, 16, 771000000, time.UTC)
+	startTime, err = guessStartTime([]uint64{snowflakeID}, SnowflakeLayout.Bits, now)
+	if err != nil || !startTime.Equal(SnowflakeLayout.StartTime) {
+		t.Errorf("unexpected snowflake start time: %v, %v", startTime, err)
+	}
+
+	testCases := []struct {
+		ids      []uint64
+		layout   BitLayout
+		expected error
+	}{
+		{nil, DefaultLayout, ErrNoIDs},
+		{ids, BitLayout{}, ErrInvalidBitLength},
+		{[]uint64{1 << 63}, DefaultLayout, ErrInvalidID},
+		{[]uint64{1, 2}, DefaultLayout, ErrImplausibleStartTime},
+		{[]uint64{1<<63 - 1}, BitLayout{Time: 61, Sequence: 1, MachineID: 1}, ErrImplausibleStartTime},
+	}
+	for _, tc := range testCases {
+		if _, err := guessStartTime(tc.ids, tc.layout, now); err != tc.expected {
+			t.Errorf("unexpected error for %v: %v", tc.ids, err)
+		}
+	}
+
+	if _, err := GuessStartTime(ids, DefaultLayout); err != nil {
+		t.Errorf("unexpected error: %v", err)
+	}
+}
+
+func TestMachineIDs(t *testing.T) {
+	var ids []uint64
+	for i, machineID := range []uint64{1, 2, 1, 0xffff, 1, 2} {
+		id, err := DefaultLayout.Compose(uint64(i), 0, machineID)
+		if err != nil {
+			t.Fatal(err)
+		}
+		ids = append(ids, id)
+	}
+	expected := map[uint16]int{1: 3, 2: 2, 0xffff: 1}
+	if actual := MachineIDs(ids); !reflect.DeepEqual(actual, expected) {
+		t.Errorf("unexpected machine ids: %v", actual)
+	}
+
+	ids = ids[:0]
+	for i, machineID := range []uint64{0x3ff, 5, 5} {
+		id, err := SnowflakeLayout.Bits.Compose(uint64(i), 0xfff, machineID)
+		if err != nil {
+			t.Fatal(err)
+		}
+		ids = append(ids, id)
+	}
+	wideExpected := map[uint64]int{0x3ff: 1, 5: 2}
+	if actual := SnowflakeLayout.Bits.MachineIDs(ids); !reflect.DeepEqual(actual, wideExpected) {
+		t.Errorf("unexpected machine ids: %v", actual)
+	}
+
+	// Machine ids wider than 16 bits are tallied apart.
+	wide, err := NewBitLayout(39, 0, 24)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ids = ids[:0]
+	for i, machineID := range []uint64{1, 1 + 1<<16, 1} {
+		id, err := wide.Compose(uint64(i), 0, machineID)
+		if err != nil {
+			t.Fatal(err)
+		}
+		ids = append(ids, id)
+	}
+	wideExpected = map[uint64]int{1: 2, 1 + 1<<16: 1}
+	if actual := wide.MachineIDs(ids); !reflect.DeepEqual(actual, wideExpected) {
+		t.Errorf("unexpected machine ids: %v", actual)
+	}
+
+	if actual := MachineIDs(nil); len(actual) != 0 {
+		t.Errorf("unexpected machine ids: %v", actual)
+	}
+}
+
+func TestMasks(t *testing.T) {
+	timeMask, sequenceMask, machineIDMask := DefaultLayout.Masks()
+	if timeMask != TimeMask || sequenceMask != SequenceMask || machineIDMask != MachineIDMask {
+		t.Errorf("unexpected default masks: %x, %x, %x", timeMask, sequenceMask, machineIDMask)
+	}
+	if TimeMask != 0x7fffffffff000000 || SequenceMask != 0xff0000 || MachineIDMask != 0xffff {
+		t.Errorf("unexpected mask constants: %x, %x, %x", TimeMask, SequenceMask, MachineIDMask)
+	}
+
+	for _, b := range []BitLayout{DefaultLayout, SnowflakeLayout.Bits, {Time: 63}, {Time: 1, Sequence: 31, MachineID: 31}} {
+		timeMask, sequenceMask, machineIDMask := b.Masks()
+		if timeMask&sequenceMask != 0 || sequenceMask&machineIDMask != 0 || timeMask|sequenceMask|machineIDMask != 1<<63-1 {
+			t.Errorf("unexpected masks of %+v: %x, %x, %x", b, timeMask, sequenceMask, machineIDMask)
+		}
+
+		id := uint64(0x0123456789abcdef)
+		parts := b.Decompose(id)
+		if parts.Time != id&timeMask>>(b.Sequence+b.MachineID) ||
+			parts.Sequence != id&sequenceMask>>b.MachineID || parts.MachineID != id&machineIDMask {
+			t.Errorf("masks of %+v disagree with Decompose: %+v", b, parts)
+		}
+	}
+}
@@ -0,0 +1,124 @@
+package snooflake
+
+import (
+	"errors"
+	"fmt"
+	"hash/fnv"
+	"net"
+	"os"
+	"strconv"
+	"strings"
+)
+
+// MachineIDFromEnv returns a function to be used as Settings.MachineID.
+// The function reads the machine id from the environment variable named by key
+// as a decimal integer that fits in BitLenMachineID bits.
+func MachineIDFromEnv(key string) func() (uint16, error) {
+	return func() (uint16, error) {
+		v, ok := os.LookupEnv(key)
+		if !ok {
+			return 0, fmt.Errorf("environment variable %s is not set", key)
+		}
+
+		id, err := strconv.ParseUint(v, 10, BitLenMachineID)
+		if err != nil {
+			return 0, fmt.Errorf("environment variable %s: %w", key, err)
+		}
+		return uint16(id), nil
+	}
+}
+
+// MachineIDFromHostname returns a function to be used as Settings.MachineID.
+// The function hashes the host name with HashMachineID.
+// Since different host names may hash to the same machine id,
+// use Settings.CheckMachineID to validate its uniqueness.
+func MachineIDFromHostname() func() (uint16, error) {
+	return func() (uint16, error) {
+		hostname, err := os.Hostname()
+		if err != nil {
+			return 0, err
+		}
+		return HashMachineID(hostname), nil
+	}
+}
+
+// HashMachineID hashes s into a machine id with 32-bit FNV-1a, XOR-folding the hash into 16 bits.
+// It is used by MachineIDFromHostname and the machine ids of the cloud packages,
+// and is stable across releases, so a host keeps its machine id.
+func HashMachineID(s string) uint16 {
+	h := fnv.New32a()
+	h.Write([]byte(s))
+	sum := h.Sum32()
+	return uint16(sum>>16) ^ uint16(sum)
+}
+
+// MachineIDFromPodName returns a function to be used as Settings.MachineID.
+// The function uses the ordinal of a Kubernetes StatefulSet pod as the machine id,
+// which is the numeric suffix of the pod name such as 3 of "web-3".
+// The pod name is read from the environment variable HOSTNAME, or else the host name.
+func MachineIDFromPodName() func() (uint16, error) {
+	return func() (uint16, error) {
+		name := os.Getenv("HOSTNAME")
+		if name == "" {
+			var err error
+			name, err = os.Hostname()
+			if err != nil {
+				return 0, err
+			}
+		}
+		return podOrdinal(name)
+	}
+}
+
+func podOrdinal(name string) (uint16, error) {
+	i := strings.LastIndexByte(name, '-')
+	if i < 0 {
+		return 0, fmt.Errorf("pod name %q has no ordinal", name)
+	}
+
+	ordinal, err := strconv.ParseUint(name[i+1:], 10, BitLenMachineID)
+	if err != nil {
+		return 0, fmt.Errorf("pod name %q has no ordinal: %w", name, err)
+	}
+	return uint16(ordinal), nil
+}
+
+// MachineIDFromMAC returns a function to be used as Settings.MachineID
+// on hosts without a private IP address, such as bare-metal hosts.
+// The function uses the last two octets of the hardware address of the first network interface,
+// in the order of the interface index, that is not a loopback interface.
+// Zero and locally administered hardware addresses, which are typical of virtual interfaces
+// such as Docker bridges and veth pairs, are skipped.
+func MachineIDFromMAC() func() (uint16, error) {
+	return func() (uint16, error) {
+		interfaces, err := net.Interfaces()
+		if err != nil {
+			return 0, err
+		}
+		return macMachineID(interfaces)
+	}
+}
+
+func macMachineID(interfaces []net.Interface) (uint16, error) {
+	for _, i := range interfaces {
+		if i.Flags&net.FlagLoopback != 0 || !isUniversalMAC(i.HardwareAddr) {
+			continue
+		}
+		mac := i.HardwareAddr
+		return uint16(mac[len(mac)-2])<<8 + uint16(mac[len(mac)-1]), nil
+	}
+	return 0, errors.New("no network interface with a hardware address")
+}
+
+// isUniversalMAC reports whether mac is a nonzero, universally administered hardware address.
+func isUniversalMAC(mac net.HardwareAddr) bool {
+	if len(mac) < 2 || mac[0]&0x02 != 0 {
+		return false
+	}
+	for _, b := range mac {
+		if b != 0 {
+			return true
+		}
+	}
+	return false
+}
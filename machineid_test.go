@@ -0,0 +1,188 @@
+package snooflake
+
+import (
+	"fmt"
+	"net"
+	"os"
+	"testing"
+)
+
+func TestMachineIDFromEnv(t *testing.T) {
+	const key = "SNOOFLAKE_TEST_MACHINE_ID"
+	machineID := MachineIDFromEnv(key)
+
+	os.Unsetenv(key)
+	if _, err := machineID(); err == nil {
+		t.Errorf("machine id from unset variable")
+	}
+
+	os.Setenv(key, "65535")
+	defer os.Unsetenv(key)
+	if id, err := machineID(); err != nil || id != 65535 {
+		t.Errorf("unexpected machine id: %d, %v", id, err)
+	}
+
+	invalid := []string{"", "-1", "65536", "0x10", "abc"}
+	for _, v := range invalid {
+		os.Setenv(key, v)
+		if _, err := machineID(); err == nil {
+			t.Errorf("machine id from %q", v)
+		}
+	}
+}
+
+func TestMachineIDFromHostname(t *testing.T) {
+	hostname, err := os.Hostname()
+	if err != nil {
+		t.Skip(err)
+	}
+
+	id, err := MachineIDFromHostname()()
+	if err != nil || id != HashMachineID(hostname) {
+		t.Errorf("unexpected machine id: %d, %v", id, err)
+	}
+}
+
+func TestHashMachineID(t *testing.T) {
+	// The hash must not change across releases.
+	expected := map[string]uint16{
+		"":          0x811c ^ 0x9dc5,
+		"localhost": 0x766a,
+	}
+	for s, id := range expected {
+		if actual := HashMachineID(s); actual != id {
+			t.Errorf("unexpected hash of %q: %#04x", s, actual)
+		}
+	}
+}
+
+func TestPrivateIP(t *testing.T) {
+	cidr := func(s string) net.Addr {
+		ip, ipnet, err := net.ParseCIDR(s)
+		if err != nil {
+			t.Fatal(err)
+		}
+		ipnet.IP = ip
+		return ipnet
+	}
+
+	testCases := []struct {
+		addrs    []net.Addr
+		expected string
+	}{
+		{[]net.Addr{cidr("127.0.0.1/8"), cidr("192.168.1.2/24")}, "192.168.1.2"},
+		{[]net.Addr{cidr("fd00::1:2/64"), cidr("10.0.1.2/16")}, "10.0.1.2"},
+		{[]net.Addr{cidr("::1/128"), cidr("fe80::a:b/64"), cidr("fd12::3:4/64")}, "fd12::3:4"},
+		{[]net.Addr{cidr("8.8.8.8/32"), cidr("fe80::a:b/64")}, "fe80::a:b"},
+	}
+	for _, tc := range testCases {
+		ip, err := privateIP(tc.addrs)
+		if err != nil || !ip.Equal(net.ParseIP(tc.expected)) {
+			t.Errorf("unexpected ip: %v, %v", ip, err)
+		}
+	}
+
+	if _, err := privateIP([]net.Addr{cidr("8.8.8.8/32"), cidr("2001:db8::1/64")}); err == nil {
+		t.Errorf("private ip from public addresses")
+	}
+}
+
+func TestMachineIDFromPodName(t *testing.T) {
+	hostname := os.Getenv("HOSTNAME")
+	defer os.Setenv("HOSTNAME", hostname)
+
+	os.Setenv("HOSTNAME", "web-3")
+	if id, err := MachineIDFromPodName()(); err != nil || id != 3 {
+		t.Errorf("unexpected machine id: %d, %v", id, err)
+	}
+
+	valid := map[string]uint16{"web-0": 0, "my-app-db-12": 12, "-65535": 65535}
+	for name, expected := range valid {
+		if id, err := podOrdinal(name); err != nil || id != expected {
+			t.Errorf("unexpected ordinal of %q: %d, %v", name, id, err)
+		}
+	}
+
+	invalid := []string{"web", "web-", "web-a", "web-65536", "web-3x"}
+	for _, name := range invalid {
+		if _, err := podOrdinal(name); err == nil {
+			t.Errorf("ordinal of %q", name)
+		}
+	}
+}
+
+func TestMachineIDFromMAC(t *testing.T) {
+	mac := func(s string) net.HardwareAddr {
+		addr, err := net.ParseMAC(s)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return addr
+	}
+
+	interfaces := []net.Interface{
+		{Index: 1, Name: "lo", Flags: net.FlagLoopback, HardwareAddr: mac("00:00:5e:00:53:01")},
+		{Index: 2, Name: "docker0", HardwareAddr: mac("02:42:ac:11:00:02")},
+		{Index: 3, Name: "tun0"},
+		{Index: 4, Name: "eth0", HardwareAddr: mac("00:00:00:00:00:00")},
+		{Index: 5, Name: "eth1", HardwareAddr: mac("00:1b:21:3a:4f:5c")},
+		{Index: 6, Name: "eth2", HardwareAddr: mac("00:1b:21:3a:4f:5d")},
+	}
+	id, err := macMachineID(interfaces)
+	if err != nil || id != 0x4f5c {
+		t.Errorf("unexpected machine id: %#x, %v", id, err)
+	}
+
+	if _, err := macMachineID(interfaces[:4]); err == nil {
+		t.Error("machine id without a suitable interface")
+	}
+}
+
+func TestIPSelection(t *testing.T) {
+	interfaces, err := net.Interfaces()
+	if err != nil {
+		t.Fatal(err)
+	}
+	var loopback *net.Interface
+	for i := range interfaces {
+		if interfaces[i].Flags&net.FlagLoopback != 0 {
+			loopback = &interfaces[i]
+			break
+		}
+	}
+	if loopback == nil {
+		t.Skip("no loopback interface")
+	}
+	expected, err := loopback.Addrs()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var selected []net.Addr
+	var st Settings
+	st.PreferredInterface = loopback.Name
+	st.IPSelector = func(as []net.Addr) (net.IP, error) {
+		selected = as
+		return net.ParseIP("10.0.3.4"), nil
+	}
+	sf, err := NewSnooflakeWithError(st)
+	if err != nil {
+		t.Fatalf("snooflake not created: %v", err)
+	}
+	if sf.MachineID() != 0x0304 {
+		t.Errorf("unexpected machine id: %#x", sf.MachineID())
+	}
+	if fmt.Sprint(selected) != fmt.Sprint(expected) {
+		t.Errorf("unexpected addresses of %s: %v", loopback.Name, selected)
+	}
+
+	st.IPSelector = func([]net.Addr) (net.IP, error) { return nil, nil }
+	if _, err := NewSnooflakeWithError(st); err == nil {
+		t.Error("snooflake created with no ip address")
+	}
+
+	st.PreferredInterface = "no-such-interface"
+	if _, err := NewSnooflakeWithError(st); err == nil {
+		t.Error("snooflake created with an unknown interface")
+	}
+}
@@ -0,0 +1,70 @@
+package snooflake
+
+// obfuscateBits is the number of the low bits permuted by Obfuscator,
+// that is, the bits of the sequence number and the machine id for any bit lengths.
+const obfuscateBits = 63 - BitLenTime
+
+const (
+	obfuscateHalfBits = obfuscateBits / 2
+	obfuscateHalfMask = 1<<obfuscateHalfBits - 1
+	obfuscateRounds   = 4
+)
+
+// Obfuscator permutes the sequence number and the machine id of Snooflake IDs with a key
+// so that the IDs do not expose the generation rate, e.g. for public-facing IDs.
+//
+// The permutation is a Feistel network over the low 24 bits tweaked by the time part.
+// It is bijective for each time, so the obfuscated IDs are still unique,
+// and it keeps the time part, so the obfuscated IDs are still ordered across time units.
+// It obscures but does not encrypt the IDs; it is not a substitute for access control.
+//
+// WARNING: the permutation is bijective only for a single key. IDs obfuscated with different keys,
+// or obfuscated and not obfuscated, may collide even if their machine ids differ,
+// so every generator sharing an ID space must use an Obfuscator with the same key, or none at all.
+type Obfuscator struct {
+	keys [obfuscateRounds]uint64
+}
+
+// NewObfuscator returns an Obfuscator with the given key.
+// The same key must be used to decode the IDs obfuscated with it.
+func NewObfuscator(key uint64) *Obfuscator {
+	o := new(Obfuscator)
+	for i := range o.keys {
+		key += 0x9e3779b97f4a7c15
+		o.keys[i] = mix64(key)
+	}
+	return o
+}
+
+// Encode obfuscates the sequence number and the machine id of id.
+func (o *Obfuscator) Encode(id uint64) uint64 {
+	tweak := id >> obfuscateBits
+	left := id >> obfuscateHalfBits & obfuscateHalfMask
+	right := id & obfuscateHalfMask
+	for _, key := range o.keys {
+		left, right = right, left^o.round(right, tweak, key)
+	}
+	return tweak<<obfuscateBits | left<<obfuscateHalfBits | right
+}
+
+// Decode returns the original ID of an ID obfuscated by Encode.
+func (o *Obfuscator) Decode(id uint64) uint64 {
+	tweak := id >> obfuscateBits
+	left := id >> obfuscateHalfBits & obfuscateHalfMask
+	right := id & obfuscateHalfMask
+	for i := len(o.keys) - 1; i >= 0; i-- {
+		left, right = right^o.round(left, tweak, o.keys[i]), left
+	}
+	return tweak<<obfuscateBits | left<<obfuscateHalfBits | right
+}
+
+func (o *Obfuscator) round(half, tweak, key uint64) uint64 {
+	return mix64(half^tweak<<obfuscateHalfBits^key) & obfuscateHalfMask
+}
+
+// mix64 is the finalizer of SplitMix64.
+func mix64(x uint64) uint64 {
+	x = (x ^ x>>30) * 0xbf58476d1ce4e5b9
+	x = (x ^ x>>27) * 0x94d049bb133111eb
+	return x ^ x>>31
+}
@@ -0,0 +1,83 @@
+package snooflake
+
+import (
+	"testing"
+	"time"
+)
+
+func TestObfuscatorBijective(t *testing.T) {
+	o := NewObfuscator(42)
+	tweak := uint64(0x123456789) << obfuscateBits
+
+	seen := make([]uint64, 1<<obfuscateBits/64)
+	for low := uint64(0); low < 1<<obfuscateBits; low++ {
+		id := tweak | low
+		encoded := o.Encode(id)
+		if encoded>>obfuscateBits != id>>obfuscateBits {
+			t.Fatalf("time of %#x changed: %#x", id, encoded)
+		}
+
+		i := encoded & (1<<obfuscateBits - 1)
+		if seen[i/64]&(1<<(i%64)) != 0 {
+			t.Fatalf("%#x encoded to a duplicate %#x", id, encoded)
+		}
+		seen[i/64] |= 1 << (i % 64)
+
+		if decoded := o.Decode(encoded); decoded != id {
+			t.Fatalf("%#x decoded to %#x", id, decoded)
+		}
+	}
+}
+
+func TestObfuscatorKey(t *testing.T) {
+	id := uint64(0x0123456789abcdef)
+	a, b := NewObfuscator(1), NewObfuscator(2)
+	if a.Encode(id) == id || a.Encode(id) == b.Encode(id) {
+		t.Error("id not obfuscated by the key")
+	}
+	if NewObfuscator(1).Decode(a.Encode(id)) != id {
+		t.Error("id not decoded by the same key")
+	}
+	if b.Decode(a.Encode(id)) == id {
+		t.Error("id decoded by another key")
+	}
+}
+
+func TestObfuscate(t *testing.T) {
+	sf, _ := newFakeClockSnooflake(t)
+	raw, err := sf.NextIDs(10)
+	if err != nil {
+		t.Fatal("ids not generated")
+	}
+	for i, id := range raw {
+		if parts := DecomposeParts(id); parts.Sequence != uint64(i) || parts.MachineID != 1 {
+			t.Errorf("unexpected parts of raw id: %+v", parts)
+		}
+	}
+
+	o := NewObfuscator(42)
+	clock := &fakeClock{now: time.Date(2020, 1, 1, 0, 0, 0, 0, time.UTC)}
+	var st Settings
+	st.StartTime = clock.Now()
+	st.NowFunc = clock.Now
+	st.MachineID = func() (uint16, error) { return 1, nil }
+	st.Obfuscate = o
+	sf = NewSnooflake(st)
+
+	ids, err := sf.NextIDs(10)
+	if err != nil {
+		t.Fatal("ids not generated")
+	}
+	sequential := 0
+	for i, id := range ids {
+		if parts := DecomposeParts(id); parts.Sequence == uint64(i) && parts.MachineID == 1 {
+			sequential++
+		}
+		if parts := DecomposeParts(o.Decode(id)); parts.Sequence != uint64(i) || parts.MachineID != 1 {
+			t.Errorf("unexpected parts of decoded id: %+v", parts)
+		}
+	}
+	if sequential == len(ids) {
+		t.Error("ids not obfuscated")
+	}
+}
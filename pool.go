@@ -0,0 +1,93 @@
+package snooflake
+
+import (
+	"errors"
+	"fmt"
+	"sync/atomic"
+)
+
+// ErrInvalidPool is returned by NewPool when the members of the Pool could generate colliding IDs.
+var ErrInvalidPool = errors.New("invalid pool settings")
+
+// Pool generates unique IDs with several Snooflakes of distinct machine ids,
+// which multiplies the number of IDs per time unit beyond the sequence capacity of a single Snooflake
+// and spreads the contention of concurrent callers over the members.
+// It is safe for concurrent use by multiple goroutines.
+// Unlike a Snooflake, the IDs returned to a goroutine are not in ascending order within a time unit,
+// since consecutive IDs come from different members.
+type Pool struct {
+	members []*Snooflake
+	next    uint64
+}
+
+var _ Generator = (*Pool)(nil)
+
+// NewPool returns a new Pool of the Snooflakes configured with the given Settings.
+// The members must have distinct machine ids and the same start time, time unit, bit lengths and Obfuscate key,
+// or NewPool returns ErrInvalidPool, wrapped.
+// If a member cannot be created, NewPool returns the error of NewSnooflakeWithError.
+func NewPool(settings []Settings) (*Pool, error) {
+	if len(settings) == 0 {
+		return nil, fmt.Errorf("%w: no member", ErrInvalidPool)
+	}
+
+	p := &Pool{members: make([]*Snooflake, 0, len(settings))}
+	machineIDs := make(map[uint16]bool, len(settings))
+	for _, st := range settings {
+		sf, err := NewSnooflakeWithError(st)
+		if err != nil {
+			p.Close()
+			return nil, err
+		}
+		p.members = append(p.members, sf)
+
+		if machineIDs[sf.machineID] {
+			p.Close()
+			return nil, fmt.Errorf("%w: duplicate machine id %d", ErrInvalidPool, sf.machineID)
+		}
+		machineIDs[sf.machineID] = true
+
+		if !sameLayout(sf, p.members[0]) {
+			p.Close()
+			return nil, fmt.Errorf("%w: layout of machine id %d differs", ErrInvalidPool, sf.machineID)
+		}
+	}
+	return p, nil
+}
+
+// sameLayout reports whether a and b generate IDs in the same layout,
+// including the Obfuscator, whose IDs collide with the IDs obfuscated by another key.
+func sameLayout(a, b *Snooflake) bool {
+	ca, cb := a.Config(), b.Config()
+	ca.MachineID, cb.MachineID = 0, 0
+	if ca != cb {
+		return false
+	}
+	if a.obfuscator == nil || b.obfuscator == nil {
+		return a.obfuscator == b.obfuscator
+	}
+	return *a.obfuscator == *b.obfuscator
+}
+
+// NextID generates a next unique ID by the members of p in turn.
+func (p *Pool) NextID() (uint64, error) {
+	return p.member().NextID()
+}
+
+// NextIDs generates num next unique IDs in ascending order by one of the members of p.
+func (p *Pool) NextIDs(num int) ([]uint64, error) {
+	return p.member().NextIDs(num)
+}
+
+func (p *Pool) member() *Snooflake {
+	i := atomic.AddUint64(&p.next, 1)
+	return p.members[i%uint64(len(p.members))]
+}
+
+// Close closes the members of p. It always returns nil.
+func (p *Pool) Close() error {
+	for _, sf := range p.members {
+		sf.Close()
+	}
+	return nil
+}
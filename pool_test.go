@@ -0,0 +1,113 @@
+package snooflake
+
+import (
+	"errors"
+	"fmt"
+	"testing"
+	"time"
+)
+
+func newPoolSettings(machineIDs ...uint16) []Settings {
+	settings := make([]Settings, len(machineIDs))
+	for i, machineID := range machineIDs {
+		machineID := machineID
+		settings[i].MachineID = func() (uint16, error) { return machineID, nil }
+	}
+	return settings
+}
+
+func TestPool(t *testing.T) {
+	p, err := NewPool(newPoolSettings(1, 2, 3))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer p.Close()
+
+	seen := make(map[uint64]bool)
+	machineIDs := make(map[uint64]int)
+	for i := 0; i < 3000; i++ {
+		id, err := p.NextID()
+		if err != nil {
+			t.Fatal("id not generated")
+		}
+		if seen[id] {
+			t.Fatalf("duplicate id: %d", id)
+		}
+		seen[id] = true
+		machineIDs[DecomposeParts(id).MachineID]++
+	}
+	if fmt.Sprint(machineIDs) != "map[1:1000 2:1000 3:1000]" {
+		t.Errorf("unexpected distribution: %v", machineIDs)
+	}
+
+	ids, err := p.NextIDs(100)
+	if err != nil || len(ids) != 100 {
+		t.Fatalf("ids not generated: %v", err)
+	}
+	for _, id := range ids {
+		if DecomposeParts(id).MachineID != DecomposeParts(ids[0]).MachineID {
+			t.Errorf("batch from several members: %d", id)
+		}
+	}
+
+	p.Close()
+	if _, err := p.NextID(); err != ErrClosed {
+		t.Errorf("unexpected error after close: %v", err)
+	}
+}
+
+func TestNewPoolError(t *testing.T) {
+	if _, err := NewPool(nil); !errors.Is(err, ErrInvalidPool) {
+		t.Errorf("unexpected error without members: %v", err)
+	}
+	if _, err := NewPool(newPoolSettings(1, 2, 1)); !errors.Is(err, ErrInvalidPool) {
+		t.Errorf("unexpected error on duplicate machine ids: %v", err)
+	}
+
+	settings := newPoolSettings(1, 2)
+	settings[1].TimeUnit = 10 * time.Millisecond
+	if _, err := NewPool(settings); !errors.Is(err, ErrInvalidPool) {
+		t.Errorf("unexpected error on different layouts: %v", err)
+	}
+
+	settings = newPoolSettings(1, 2)
+	settings[0].Obfuscate = NewObfuscator(1)
+	if _, err := NewPool(settings); !errors.Is(err, ErrInvalidPool) {
+		t.Errorf("unexpected error on a missing obfuscator: %v", err)
+	}
+	settings[1].Obfuscate = NewObfuscator(2)
+	if _, err := NewPool(settings); !errors.Is(err, ErrInvalidPool) {
+		t.Errorf("unexpected error on different obfuscator keys: %v", err)
+	}
+	settings[1].Obfuscate = NewObfuscator(1)
+	p, err := NewPool(settings)
+	if err != nil {
+		t.Errorf("unexpected error on the same obfuscator key: %v", err)
+	} else {
+		p.Close()
+	}
+
+	settings = newPoolSettings(1, 2)
+	settings[1].StartTime = time.Now().Add(time.Hour)
+	if _, err := NewPool(settings); err != ErrStartTimeAhead {
+		t.Errorf("unexpected error of member: %v", err)
+	}
+}
+
+// BenchmarkPoolConcurrency compares a Pool of 4 members with a single Snooflake,
+// both with the default 8-bit sequence saturated by the concurrent callers.
+func BenchmarkPoolConcurrency(b *testing.B) {
+	for _, numGoroutine := range []int{1, 8, 64} {
+		b.Run(fmt.Sprintf("single/%d", numGoroutine), func(b *testing.B) {
+			sf := NewSnooflake(newPoolSettings(1)[0])
+			benchmarkConcurrently(b, numGoroutine, sf.NextID)
+		})
+		b.Run(fmt.Sprintf("pool/%d", numGoroutine), func(b *testing.B) {
+			p, err := NewPool(newPoolSettings(1, 2, 3, 4))
+			if err != nil {
+				b.Fatal(err)
+			}
+			benchmarkConcurrently(b, numGoroutine, p.NextID)
+		})
+	}
+}
@@ -0,0 +1,59 @@
+package snooflake
+
+import (
+	"encoding/binary"
+	"io"
+)
+
+// Reader returns an io.Reader reading consecutive IDs generated by sf,
+// each encoded in 8 bytes in big endian as by ID.Bytes,
+// e.g. to write an ID file or to pipe IDs to another process.
+// Each Read generates just enough IDs to fill the buffer, but at most Settings.MaxBatch or MaxBatchLen IDs.
+// If the buffer ends in the middle of an ID, the rest of the ID is read by the next Read.
+// The Reader is not safe for concurrent use, but sf may be shared with other callers.
+// Read returns the bytes read before an error such as ErrOverTimeLimit along with it.
+// Near the time limit, Read fills the buffer with the IDs left, and then returns ErrOverTimeLimit.
+func (sf *Snooflake) Reader() io.Reader {
+	return &idReader{sf: sf}
+}
+
+type idReader struct {
+	sf      *Snooflake
+	buf     [8]byte
+	pending []byte // unread bytes of the last ID in buf
+}
+
+func (r *idReader) Read(p []byte) (int, error) {
+	n := copy(p, r.pending)
+	r.pending = r.pending[n:]
+	if n == len(p) {
+		return n, nil
+	}
+
+	num := (len(p) - n + 7) / 8
+	if num > MaxBatchLen {
+		num = MaxBatchLen
+	}
+	if r.sf.maxBatch > 0 && num > r.sf.maxBatch {
+		num = r.sf.maxBatch
+	}
+	if r.sf.onOverflow != OverflowRecycle {
+		if remaining := r.sf.remainingIDs(); int64(num) > remaining {
+			num = int(remaining)
+		}
+		if num == 0 {
+			if n > 0 {
+				return n, nil
+			}
+			return 0, ErrOverTimeLimit
+		}
+	}
+	ids, err := r.sf.NextIDs(num)
+	for _, id := range ids {
+		binary.BigEndian.PutUint64(r.buf[:], id)
+		m := copy(p[n:], r.buf[:])
+		r.pending = r.buf[m:]
+		n += m
+	}
+	return n, err
+}
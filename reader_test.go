@@ -0,0 +1,76 @@
+package snooflake
+
+import (
+	"bytes"
+	"encoding/binary"
+	"io"
+	"testing"
+	"time"
+)
+
+func TestReader(t *testing.T) {
+	sf, clock := newFakeClockSnooflake(t)
+	clock.Add(10 * time.Millisecond)
+	r := sf.Reader()
+
+	// Read IDs through buffers ending in the middle of an ID.
+	var b []byte
+	for _, size := range []int{8, 3, 13, 0, 1, 16, 7} {
+		p := make([]byte, size)
+		n, err := r.Read(p)
+		if err != nil || n != size {
+			t.Fatalf("unexpected read: %d, %v", n, err)
+		}
+		b = append(b, p...)
+	}
+
+	if len(b)%8 != 0 {
+		t.Fatalf("unexpected length: %d", len(b))
+	}
+	for i := 0; i < len(b)/8; i++ {
+		id := binary.BigEndian.Uint64(b[i*8:])
+		if parts := DecomposeParts(id); parts.Time != 10 || parts.Sequence != uint64(i) || parts.MachineID != 1 {
+			t.Errorf("unexpected parts: %+v", parts)
+		}
+	}
+
+	if sf.Sequence() != uint16(len(b)/8-1) {
+		t.Errorf("unexpected number of generated ids: %d", sf.Sequence()+1)
+	}
+}
+
+func TestReaderOverTimeLimit(t *testing.T) {
+	sf, clock := newFakeClockSnooflake(t)
+	clock.Add((1<<BitLenTime - 1) * time.Millisecond)
+
+	b, err := io.ReadAll(io.LimitReader(sf.Reader(), 8<<BitLenSequence))
+	if err != nil || len(b) != 8<<BitLenSequence {
+		t.Fatalf("unexpected read: %d, %v", len(b), err)
+	}
+
+	var buf bytes.Buffer
+	if n, err := io.Copy(&buf, sf.Reader()); err != ErrOverTimeLimit || n != 0 {
+		t.Errorf("unexpected copy: %d, %v", n, err)
+	}
+
+	// A buffer larger than the IDs left is filled with them rather than left empty.
+	sf, clock = newFakeClockSnooflake(t)
+	clock.Add((1<<BitLenTime - 1) * time.Millisecond)
+	if _, err := sf.NextIDs(1<<BitLenSequence - 6); err != nil {
+		t.Fatal(err)
+	}
+	r := sf.Reader()
+	p := make([]byte, 8*10+3)
+	if n, err := r.Read(p[:3]); err != nil || n != 3 {
+		t.Fatalf("unexpected read: %d, %v", n, err)
+	}
+	if n, err := r.Read(p[3:]); err != nil || n != 8*6-3 {
+		t.Errorf("unexpected read: %d, %v", n, err)
+	}
+	if n, err := r.Read(p); err != ErrOverTimeLimit || n != 0 {
+		t.Errorf("unexpected read: %d, %v", n, err)
+	}
+	if n, err := io.ReadFull(sf.Reader(), p); err != ErrOverTimeLimit || n != 0 {
+		t.Errorf("unexpected full read: %d, %v", n, err)
+	}
+}
@@ -0,0 +1,199 @@
+// Package redisid provides a machine id allocator for Snooflake backed by Redis.
+package redisid
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// RedisClient is the subset of Redis commands used by Allocator.
+// It is easily implemented by wrapping a client such as go-redis.
+type RedisClient interface {
+	// SetNX sets key to value with the expiration ttl if key does not exist,
+	// and reports whether key was set.
+	SetNX(key, value string, ttl time.Duration) (bool, error)
+	// Get returns the value of key, or "" if key does not exist.
+	Get(key string) (string, error)
+	// Expire sets the expiration ttl of key.
+	Expire(key string, ttl time.Duration) error
+	// Del deletes key.
+	Del(key string) error
+}
+
+// CompareAndDeleter is optionally implemented by a RedisClient
+// to delete a key atomically only if it has the given value, e.g. by a Lua script.
+// Without it, release reads the key and then deletes it, so if the lease expires and
+// another process leases the machine id in between, release deletes the lease of the other process.
+type CompareAndDeleter interface {
+	// DelIfEqual deletes key if its value is value, and reports whether key was deleted.
+	DelIfEqual(key, value string) (bool, error)
+}
+
+// randRead reads the random token, and is replaced in tests.
+var randRead = rand.Read
+
+// These errors are returned by the functions of Allocator.
+var (
+	ErrInvalidTTL = errors.New("ttl too short to renew the lease")
+	ErrLeaseLost  = errors.New("machine id lease lost")
+)
+
+type allocator struct {
+	client       RedisClient
+	key          string
+	ttl          time.Duration
+	maxMachineID uint16
+	token        string
+	tokenErr     error
+
+	mutex     sync.Mutex
+	leased    bool
+	machineID uint16
+	done      chan struct{}
+}
+
+// Allocator returns functions to be used as Settings.MachineID and Settings.CheckMachineID,
+// and a function to release the leased machine id on shutdown.
+//
+// The machine id is leased by setting the Redis key "<key>:<machine id>" to a random token
+// with the expiration ttl, trying machine ids from 0 up to maxMachineID until a free one is found.
+// maxMachineID must fit in the machine id bits of the Settings, or NewSnooflake rejects the machine id,
+// e.g. 1<<snooflake.BitLenMachineID - 1 for the default bit lengths,
+// or 1<<(st.BitLenMachineID-st.BitLenMachineIDPrefix) - 1 with a machine id prefix.
+// If the random token cannot be generated, the lease function returns the error, wrapped.
+// The lease is renewed every ttl/3 in the background until release is called or the lease is lost.
+// ttl must be at least 3 nsec, or the lease function returns ErrInvalidTTL;
+// a lease without expiry is not supported since it would never be freed after a crash.
+// The check function reports whether the lease of the machine id is still held.
+func Allocator(client RedisClient, key string, ttl time.Duration, maxMachineID uint16) (func() (uint16, error), func(uint16) bool, func() error) {
+	machineID, check, _, release := AllocatorWithHeartbeat(client, key, ttl, maxMachineID)
+	return machineID, check, release
+}
+
+// AllocatorWithHeartbeat is like Allocator but also returns a function to be used as
+// Settings.MachineIDHeartbeat, which renews the lease and returns ErrLeaseLost
+// if another process holds the machine id, e.g. after the lease expired during a network partition.
+// Since the Snooflake stops generating IDs on any error of the heartbeat,
+// an error of the Redis client also stops it.
+func AllocatorWithHeartbeat(client RedisClient, key string, ttl time.Duration, maxMachineID uint16) (func() (uint16, error), func(uint16) bool, func(uint16) error, func() error) {
+	a := &allocator{
+		client:       client,
+		key:          key,
+		ttl:          ttl,
+		maxMachineID: maxMachineID,
+	}
+	a.token, a.tokenErr = newToken()
+	return a.lease, a.check, a.heartbeat, a.release
+}
+
+// newToken returns a random token identifying the lease of the process.
+// A token that is not random would let every process pass for the holder of any lease.
+func newToken() (string, error) {
+	b := make([]byte, 16)
+	if _, err := randRead(b); err != nil {
+		return "", fmt.Errorf("lease token: %w", err)
+	}
+	return hex.EncodeToString(b), nil
+}
+
+func (a *allocator) machineIDKey(machineID uint16) string {
+	return a.key + ":" + strconv.Itoa(int(machineID))
+}
+
+func (a *allocator) lease() (uint16, error) {
+	a.mutex.Lock()
+	defer a.mutex.Unlock()
+
+	if a.leased {
+		return a.machineID, nil
+	}
+	if a.tokenErr != nil {
+		return 0, a.tokenErr
+	}
+	if a.ttl/3 <= 0 {
+		return 0, ErrInvalidTTL
+	}
+
+	for id := 0; id <= int(a.maxMachineID); id++ {
+		ok, err := a.client.SetNX(a.machineIDKey(uint16(id)), a.token, a.ttl)
+		if err != nil {
+			return 0, err
+		}
+		if ok {
+			a.leased = true
+			a.machineID = uint16(id)
+			a.done = make(chan struct{})
+			go a.renew(a.machineIDKey(a.machineID), a.done)
+			return a.machineID, nil
+		}
+	}
+	return 0, errors.New("no machine id available")
+}
+
+func (a *allocator) renew(key string, done <-chan struct{}) {
+	ticker := time.NewTicker(a.ttl / 3)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			value, err := a.client.Get(key)
+			if err != nil {
+				continue
+			}
+			if value != a.token {
+				// The lease is lost, which the heartbeat reports.
+				return
+			}
+			a.client.Expire(key, a.ttl)
+		case <-done:
+			return
+		}
+	}
+}
+
+func (a *allocator) check(machineID uint16) bool {
+	value, err := a.client.Get(a.machineIDKey(machineID))
+	return err == nil && value == a.token
+}
+
+func (a *allocator) heartbeat(machineID uint16) error {
+	key := a.machineIDKey(machineID)
+	value, err := a.client.Get(key)
+	if err != nil {
+		return err
+	}
+	if value != a.token {
+		return ErrLeaseLost
+	}
+	return a.client.Expire(key, a.ttl)
+}
+
+func (a *allocator) release() error {
+	a.mutex.Lock()
+	defer a.mutex.Unlock()
+
+	if !a.leased {
+		return nil
+	}
+	close(a.done)
+	a.leased = false
+
+	key := a.machineIDKey(a.machineID)
+	if c, ok := a.client.(CompareAndDeleter); ok {
+		_, err := c.DelIfEqual(key, a.token)
+		return err
+	}
+	value, err := a.client.Get(key)
+	if err != nil {
+		return err
+	}
+	if value != a.token {
+		return nil
+	}
+	return a.client.Del(key)
+}
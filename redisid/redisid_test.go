@@ -0,0 +1,223 @@
+package redisid
+
+import (
+	"crypto/rand"
+	"errors"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stringsinc/snooflake"
+)
+
+type fakeRedis struct {
+	mutex   sync.Mutex
+	values  map[string]string
+	expires map[string]time.Duration
+}
+
+func newFakeRedis() *fakeRedis {
+	return &fakeRedis{
+		values:  make(map[string]string),
+		expires: make(map[string]time.Duration),
+	}
+}
+
+func (r *fakeRedis) SetNX(key, value string, ttl time.Duration) (bool, error) {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	if _, ok := r.values[key]; ok {
+		return false, nil
+	}
+	r.values[key] = value
+	r.expires[key] = ttl
+	return true, nil
+}
+
+func (r *fakeRedis) Get(key string) (string, error) {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	return r.values[key], nil
+}
+
+func (r *fakeRedis) Expire(key string, ttl time.Duration) error {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	r.expires[key] = ttl
+	return nil
+}
+
+func (r *fakeRedis) Del(key string) error {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	delete(r.values, key)
+	delete(r.expires, key)
+	return nil
+}
+
+const maxMachineID = 1<<snooflake.BitLenMachineID - 1
+
+func TestAllocator(t *testing.T) {
+	client := newFakeRedis()
+
+	var releases []func() error
+	for i := 0; i < 3; i++ {
+		var st snooflake.Settings
+		var release func() error
+		st.MachineID, st.CheckMachineID, release = Allocator(client, "snooflake", time.Minute, maxMachineID)
+		sf, err := snooflake.NewSnooflakeWithError(st)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if sf.MachineID() != uint16(i) {
+			t.Errorf("unexpected machine id: %d", sf.MachineID())
+		}
+		releases = append(releases, release)
+	}
+
+	if err := releases[1](); err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := client.values["snooflake:1"]; ok {
+		t.Errorf("machine id not released")
+	}
+
+	var st snooflake.Settings
+	st.MachineID, st.CheckMachineID, _ = Allocator(client, "snooflake", time.Minute, maxMachineID)
+	sf, err := snooflake.NewSnooflakeWithError(st)
+	if err != nil || sf.MachineID() != 1 {
+		t.Errorf("released machine id not reused: %v", err)
+	}
+}
+
+func TestMaxMachineID(t *testing.T) {
+	client := newFakeRedis()
+	for i := 0; i < 2; i++ {
+		machineID, _, _ := Allocator(client, "snooflake", time.Minute, 1)
+		if id, err := machineID(); err != nil || id != uint16(i) {
+			t.Fatalf("unexpected machine id: %d, %v", id, err)
+		}
+	}
+
+	machineID, _, _ := Allocator(client, "snooflake", time.Minute, 1)
+	if _, err := machineID(); err == nil {
+		t.Errorf("machine id beyond the max leased")
+	}
+}
+
+func TestTokenError(t *testing.T) {
+	errRead := errors.New("entropy unavailable")
+	randRead = func([]byte) (int, error) { return 0, errRead }
+	defer func() { randRead = rand.Read }()
+
+	machineID, _, _ := Allocator(newFakeRedis(), "snooflake", time.Minute, maxMachineID)
+	if _, err := machineID(); !errors.Is(err, errRead) {
+		t.Errorf("unexpected error: %v", err)
+	}
+}
+
+func TestCheck(t *testing.T) {
+	client := newFakeRedis()
+	machineID, check, _ := Allocator(client, "snooflake", time.Minute, maxMachineID)
+
+	id, err := machineID()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !check(id) {
+		t.Errorf("leased machine id rejected")
+	}
+
+	client.values["snooflake:0"] = "another token"
+	if check(id) {
+		t.Errorf("machine id leased by another accepted")
+	}
+}
+
+func TestInvalidTTL(t *testing.T) {
+	for _, ttl := range []time.Duration{0, 2, -time.Minute} {
+		machineID, _, _ := Allocator(newFakeRedis(), "snooflake", ttl, maxMachineID)
+		if _, err := machineID(); err != ErrInvalidTTL {
+			t.Errorf("unexpected error for ttl %v: %v", ttl, err)
+		}
+	}
+}
+
+func TestHeartbeat(t *testing.T) {
+	client := newFakeRedis()
+
+	var st snooflake.Settings
+	var heartbeat func(uint16) error
+	st.MachineID, st.CheckMachineID, heartbeat, _ = AllocatorWithHeartbeat(client, "snooflake", time.Minute, maxMachineID)
+	st.MachineIDHeartbeat = heartbeat
+	st.MachineIDHeartbeatInterval = time.Millisecond
+	sf, err := snooflake.NewSnooflakeWithError(st)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer sf.Close()
+
+	if err := heartbeat(sf.MachineID()); err != nil {
+		t.Errorf("unexpected error: %v", err)
+	}
+
+	// Another process takes over the machine id after the lease expired.
+	client.Del("snooflake:0")
+	client.SetNX("snooflake:0", "another token", time.Minute)
+	if err := heartbeat(sf.MachineID()); err != ErrLeaseLost {
+		t.Errorf("unexpected error: %v", err)
+	}
+
+	deadline := time.Now().Add(time.Second)
+	for {
+		_, err := sf.NextID()
+		if err == snooflake.ErrMachineIDConflict {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("lost lease not detected: %v", err)
+		}
+		time.Sleep(time.Millisecond)
+	}
+}
+
+type compareAndDeleteRedis struct {
+	*fakeRedis
+}
+
+func (r compareAndDeleteRedis) DelIfEqual(key, value string) (bool, error) {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	if r.values[key] != value {
+		return false, nil
+	}
+	delete(r.values, key)
+	delete(r.expires, key)
+	return true, nil
+}
+
+func TestReleaseCompareAndDelete(t *testing.T) {
+	client := compareAndDeleteRedis{newFakeRedis()}
+	machineID, _, release := Allocator(client, "snooflake", time.Minute, maxMachineID)
+	if _, err := machineID(); err != nil {
+		t.Fatal(err)
+	}
+	if err := release(); err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := client.values["snooflake:0"]; ok {
+		t.Errorf("machine id not released")
+	}
+
+	// The lease of another process is kept.
+	if _, err := machineID(); err != nil {
+		t.Fatal(err)
+	}
+	client.values["snooflake:0"] = "another token"
+	if err := release(); err != nil {
+		t.Fatal(err)
+	}
+	if client.values["snooflake:0"] != "another token" {
+		t.Errorf("lease of another process released")
+	}
+}
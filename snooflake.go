@@ -1,15 +1,23 @@
 // Package snooflake implements Snooflake, a distributed unique ID generator inspired by Twitter's Snowflake.
 //
 // A Snooflake ID is composed of
-//     39 bits for time in units of 10 msec
-//      8 bits for a sequence number
-//     16 bits for a machine id
+//
+//	39 bits for time in units of 1 msec (configurable by Settings.TimeUnit)
+//	 8 bits for a sequence number
+//	16 bits for a machine id
 package snooflake
 
 import (
+	"context"
+	"crypto/rand"
+	"encoding/binary"
 	"errors"
+	"fmt"
+	"math"
 	"net"
+	"strconv"
 	"sync"
+	"sync/atomic"
 	"time"
 )
 
@@ -20,151 +28,1373 @@ const (
 	BitLenMachineID = 63 - BitLenTime - BitLenSequence // bit length of machine id
 )
 
+// These constants are the bit masks of Snooflake ID parts with the default bit lengths,
+// e.g. id&SequenceMask>>BitLenMachineID is the sequence number.
+// BitLayout.Masks returns the masks for other bit lengths.
+const (
+	TimeMask      uint64 = (1<<BitLenTime - 1) << (BitLenSequence + BitLenMachineID)
+	SequenceMask  uint64 = (1<<BitLenSequence - 1) << BitLenMachineID
+	MachineIDMask uint64 = 1<<BitLenMachineID - 1
+)
+
+// DefaultStartTime is the start time of a Snooflake whose Settings.StartTime is 0.
+// Changing it affects only the Snooflakes created afterwards.
+var DefaultStartTime = time.Date(2014, 9, 1, 0, 0, 0, 0, time.UTC)
+
+// These errors are returned by Snooflake.
+var (
+	ErrStartTimeAhead    = errors.New("start time is ahead of now")
+	ErrInvalidMachineID  = errors.New("machine id rejected by CheckMachineID")
+	ErrInvalidBitLength  = errors.New("invalid bit length")
+	ErrInvalidTimeUnit   = errors.New("time unit is negative")
+	ErrInvalidInterval   = errors.New("heartbeat interval is negative")
+	ErrInvalidFieldOrder = errors.New("invalid field order")
+	ErrMachineIDTooLarge = errors.New("machine id exceeds the bit length")
+	ErrSequenceTooLarge  = errors.New("sequence exceeds the bit length")
+	ErrOverTimeLimit     = errors.New("over the time limit")
+	ErrNegativeCount     = errors.New("negative number of ids")
+	ErrBatchTooLarge     = errors.New("number of ids exceeds the max batch")
+	ErrSequenceExhausted = errors.New("sequence exhausted")
+
+	ErrTimeBeforeStart = errors.New("time is before the start time")
+	ErrTimeAhead       = errors.New("time is ahead of now")
+	ErrTimeInUse       = errors.New("time unit already used by NextID")
+
+	ErrClockMovedBackwards = errors.New("clock moved backwards")
+	ErrClockStuck          = errors.New("clock not advancing")
+	ErrMachineIDConflict   = errors.New("machine id conflict")
+	ErrClosed              = errors.New("snooflake closed")
+)
+
+// OverflowMode is the behavior of Snooflake when the Snooflake time overflows the time bits.
+type OverflowMode int
+
+// These are the behaviors on the time overflow.
+const (
+	OverflowError   OverflowMode = iota // fail with ErrOverTimeLimit
+	OverflowRecycle                     // wrap the time around with a new epoch
+)
+
 // Settings configures Snooflake:
 //
 // StartTime is the time since which the Snooflake time is defined as the elapsed time.
-// If StartTime is 0, the start time of the Snooflake is set to "2014-09-01 00:00:00 +0000 UTC".
-// If StartTime is ahead of the current time, Snooflake is not created.
+// If StartTime is 0, the start time of the Snooflake is set to DefaultStartTime,
+// which is "2014-09-01 00:00:00 +0000 UTC" unless changed.
+// If StartTime, or DefaultStartTime if StartTime is 0, is ahead of the current time, Snooflake is not created.
+// If StartTime is so old that the Snooflake time already overflows, Snooflake is not created
+// unless OnOverflow is OverflowRecycle.
+//
+// TimeUnit is the unit of the Snooflake time.
+// If TimeUnit is 0, the time unit is set to 1 msec.
+// If TimeUnit is negative, Snooflake is not created.
+// A longer time unit extends the lifetime of the Snooflake at the cost of the ID generation rate.
+//
+// OnOverflow is the behavior when the Snooflake time overflows the time bits.
+// If OnOverflow is OverflowError, the default, NextID returns ErrOverTimeLimit from then on.
+// If OnOverflow is OverflowRecycle, the time part wraps around to 0 and the start time moves
+// forward by 1<<BitLenTime time units, so the Snooflake keeps generating IDs.
+// WARNING: the IDs generated after the wrap-around compare lower than the IDs generated before it,
+// and the IDs of different epochs may collide, so the IDs are neither time-ordered nor unique
+// across the epochs. Use OverflowRecycle only if the IDs expire long before an epoch ends.
+//
+// BitLenSequence and BitLenMachineID split the bits following the time between
+// the sequence number and the machine id.
+// If both are 0, BitLenSequence and BitLenMachineID default to the package constants.
+// Otherwise BitLenTime + BitLenSequence + BitLenMachineID must be 63
+// and BitLenSequence must be at most 16, or Snooflake is not created.
+//
+// InitialSequence is the sequence number of the first ID generated in the time unit
+// in which the Snooflake is created, e.g. to pin the IDs in a test with a fixed clock.
+// It is intended for reproducibility; the sequence increments and wraps as usual afterwards,
+// and the IDs of the following time units start from 0.
+// If InitialSequence does not fit in BitLenSequence bits, Snooflake is not created.
+//
+// RandomizeSequenceStart makes the sequence numbers of each time unit start at a random offset
+// and wrap around, instead of at 0, so that the low bits of the IDs of distributed nodes
+// do not reveal that the nodes generate IDs at the same time.
+// The offset is derived from the time unit and a random seed of the Snooflake,
+// and the sequence is exhausted after all the sequence numbers are used as usual,
+// so the IDs of a machine are still unique within a time unit.
+// WARNING: the IDs in the same time unit are then not ordered by generation,
+// since the sequence number of a later ID may wrap around below an earlier one.
+// InitialSequence is counted from the offset, and Snooflake.Sequence and State report
+// the number of the IDs generated in the time unit minus 1 instead of a sequence number.
+//
+// FieldOrder is the order of the sequence number and the machine id following the time,
+// e.g. TimeMachineSeq for interoperability with IDs in the order of Twitter's Snowflake.
+// If FieldOrder is TimeSeqMachine, the default, the sequence number precedes the machine id.
+// If FieldOrder is not one of the FieldOrder constants, Snooflake is not created.
+// The package-level functions decomposing IDs assume the default order;
+// use Snooflake.Decompose or DecomposeWith for IDs in another order.
+//
+// ClockBackwardThreshold is how far the clock may move backwards, e.g. by an NTP correction,
+// before NextID fails. It is measured against the latest reading of the clock rather than
+// the time of the last ID, so the time units borrowed ahead of the clock on the exhausted sequence,
+// e.g. by a large NextIDs, do not count.
+// If the current time is behind the latest reading by more than ClockBackwardThreshold,
+// NextID returns ErrClockMovedBackwards instead of an ID.
+// Otherwise, or if ClockBackwardThreshold is 0, NextID waits until the clock catches up
+// with the time of the last ID, which blocks ID generation for as long as the clock moved backwards.
+//
+// ClockStuckThreshold is how many times in a row NextID may sleep on the exhausted sequence
+// without the clock advancing. Beyond it, NextID returns ErrClockStuck instead of borrowing
+// ever further time units ahead of a frozen clock, e.g. a NowFunc returning a constant.
+// The IDs reserved by the failed call are skipped.
+// If ClockStuckThreshold is 0, the clock is not checked.
+//
+// NowFunc returns the current time.
+// If NowFunc is nil, time.Now is used.
+// Injecting a fake clock makes the behavior of Snooflake deterministic in tests.
+//
+// NoWait makes NextID return ErrSequenceExhausted instead of sleeping
+// when the sequence is exhausted in the current time unit, e.g. for real-time systems
+// in which blocking is unacceptable. The caller can retry after the clock advances.
+// NextID also returns ErrSequenceExhausted instead of waiting for a clock moved backwards.
+// NextIDs fails without generating any ID if the IDs would need a sleep.
+//
+// MaxBatch caps the number of IDs generated by a single call of NextIDs or Reserve,
+// e.g. to guard against a huge allocation for a count from an untrusted client.
+// Above it, they return ErrBatchTooLarge without generating any ID.
+// If MaxBatch is 0, the number is limited only by MaxBatchLen.
+//
+// Sleeper waits for the given duration when the sequence is exhausted in the current time unit.
+// If Sleeper is nil, time.Sleep is used.
+// time.Sleep saves CPU but may oversleep because of the timer granularity of the platform.
+// A busy-spin or a runtime.Gosched loop reduces the latency spikes at the cost of CPU usage.
+//
+// SleepObserver is called with the actual duration of each sleep of NextID
+// on the exhausted sequence, measured by NowFunc, e.g. to record a histogram.
+// Frequent or long sleeps indicate that the time units are saturated.
+// If SleepObserver is nil, the sleeps are not measured.
+//
+// OnSequenceOverflow is called when the sequence is exhausted in the current time unit
+// and the ID is borrowed from the next time unit, which is a sign of running near capacity.
+// It is called on the hot path of NextID before waiting for the borrowed time unit,
+// so it should be cheap, e.g. incrementing a counter, and must not call back into the Snooflake.
+// If OnSequenceOverflow is nil, nothing is called.
+//
+// Trace is called at the end of each NextID with the total duration of the call,
+// measured by NowFunc, and whether it slept on the exhausted sequence,
+// e.g. to correlate the latency of ID generation with the latency of requests.
+// It is called even if NextID fails.
+// If Trace is nil, the calls are not measured, at no cost.
 //
 // MachineID returns the unique ID of the Snooflake instance.
 // If MachineID returns an error, Snooflake is not created.
+// If the machine id does not fit in BitLenMachineID bits, Snooflake is not created.
 // If MachineID is nil, default MachineID is used.
-// Default MachineID returns the lower 16 bits of the private IP address.
+// Default MachineID returns the lower 16 bits of the private IP address returned by PrivateIP.
+// Machine id 0 is as valid as any other: nothing treats it as unset,
+// and CheckMachineID is called for it as usual.
+//
+// MachineIDPrefix reserves the top BitLenMachineIDPrefix bits of the machine id as a namespace,
+// so that the IDs of services sharing a table never collide as long as their prefixes differ,
+// even if their machine ids do.
+// The machine id returned by MachineID must then fit in the remaining
+// BitLenMachineID - BitLenMachineIDPrefix bits, which leaves room for fewer machines,
+// e.g. 12 bits for 4096 machines with a 4-bit prefix and the default bit lengths,
+// so default MachineID returning the lower 16 bits of the IP address does not fit.
+// The machine id of the Snooflake, as returned by Snooflake.MachineID and passed to CheckMachineID,
+// is the prefix followed by the machine id returned by MachineID.
+// If MachineIDPrefix does not fit in BitLenMachineIDPrefix bits,
+// BitLenMachineIDPrefix is not less than BitLenMachineID,
+// or BitLenMachineID is more than 16 with a prefix, Snooflake is not created.
+//
+// PreferredInterface and IPSelector configure the IP address used by default MachineID.
+// On a host with several network interfaces, such as Docker bridges and overlay networks,
+// PrivateIP returns the first private IP address in the order of the interfaces,
+// which may change across restarts along with the machine id.
+// If PreferredInterface is set, only the addresses of the network interface with the name are considered.
+// If IPSelector is set, it selects the IP address among the addresses instead of PrivateIP.
 //
 // CheckMachineID validates the uniqueness of the machine ID.
-// If CheckMachineID returns false, Snooflake is not created.
+// If CheckMachineID returns false, MachineID is called again for another candidate
+// up to MachineIDRetry times, and then Snooflake is not created.
 // If CheckMachineID is nil, no validation is done.
+// Retrying supports leasing machine ids from a coordination service such as ZooKeeper or etcd.
+//
+// CheckMachineIDContext is like CheckMachineID but receives the context passed to NewSnooflakeContext,
+// so that a lookup in a coordination service can time out or be canceled,
+// and may return an error, which makes the Snooflake not created.
+// If CheckMachineIDContext is set, CheckMachineID is ignored.
+//
+// MachineIDHeartbeat checks that the machine id is still unique after the Snooflake is created,
+// e.g. by renewing its lease. It is called every MachineIDHeartbeatInterval in a background goroutine
+// until Close is called. If it returns an error, which it should only for a detected conflict,
+// the heartbeat stops and NextID returns ErrMachineIDConflict from then on.
+// If MachineIDHeartbeat is nil, no heartbeat is done.
+// If MachineIDHeartbeatInterval is 0, the interval is set to 10 seconds.
+// If it is negative, Snooflake is not created.
+//
+// Obfuscate permutes the sequence number and the machine id of the generated IDs
+// so that they do not expose the generation rate. See Obfuscator for details.
+// The obfuscated IDs are decoded by Obfuscate.Decode before Decompose.
+// If Obfuscate is nil, the IDs are not obfuscated.
+// WARNING: all the Snooflakes sharing an ID space must use the same Obfuscate key,
+// or the IDs of different machine ids may collide.
 type Settings struct {
-	StartTime      time.Time
-	MachineID      func() (uint16, error)
-	CheckMachineID func(uint16) bool
+	StartTime       time.Time
+	TimeUnit        time.Duration
+	OnOverflow      OverflowMode
+	BitLenSequence  uint8
+	BitLenMachineID uint8
+	FieldOrder      FieldOrder
+	InitialSequence uint16
+
+	RandomizeSequenceStart bool
+
+	ClockBackwardThreshold time.Duration
+	ClockStuckThreshold    int
+	NoWait                 bool
+	MaxBatch               int
+	NowFunc                func() time.Time
+	Sleeper                func(time.Duration)
+	SleepObserver          func(time.Duration)
+	OnSequenceOverflow     func()
+	Trace                  func(d time.Duration, slept bool)
+
+	MachineID             func() (uint16, error)
+	MachineIDPrefix       uint16
+	BitLenMachineIDPrefix uint8
+	PreferredInterface    string
+	IPSelector            func([]net.Addr) (net.IP, error)
+	CheckMachineID        func(uint16) bool
+	CheckMachineIDContext func(context.Context, uint16) (bool, error)
+	MachineIDRetry        int
+
+	MachineIDHeartbeat         func(uint16) error
+	MachineIDHeartbeatInterval time.Duration
+
+	Obfuscate *Obfuscator
+}
+
+// Generator generates unique IDs.
+// Snooflake implements Generator, and callers accepting a Generator can be tested with a stub.
+type Generator interface {
+	NextID() (uint64, error)
+	NextIDs(num int) ([]uint64, error)
 }
 
+var _ Generator = (*Snooflake)(nil)
+
 // Snooflake is a distributed unique ID generator.
+// It is safe for concurrent use by multiple goroutines.
+// The IDs returned to a goroutine are in ascending order.
+// Across goroutines, an ID is never ahead of the clock when returned,
+// so sorting IDs matches the order of their generation within a time unit.
 type Snooflake struct {
-	mutex       *sync.Mutex
-	startTime   int64
-	elapsedTime int64
-	sequence    uint16
-	machineID   uint16
+	// state packs the elapsed time and the sequence number of the last ID
+	// so that they are updated together by a single atomic compare-and-swap.
+	// It is the first field to be 64-bit aligned on 32-bit platforms.
+	state uint64
+
+	// clockHigh is the latest elapsed time read from the clock,
+	// against which Settings.ClockBackwardThreshold is measured.
+	clockHigh int64
+
+	startTime  int64
+	timeUnit   int64
+	onOverflow OverflowMode
+	machineID  uint16
+	now        func() time.Time
+	sleep      func(time.Duration)
+
+	// customSleep is set if Settings.Sleeper is given, which a context cannot interrupt.
+	customSleep bool
+
+	clockBackwardThreshold time.Duration
+	clockStuckThreshold    int
+	noWait                 bool
+	maxBatch               int
+	sleepObserver          func(time.Duration)
+	onSequenceOverflow     func()
+	trace                  func(time.Duration, bool)
+	obfuscator             *Obfuscator
+
+	bitLenSequence        uint8
+	bitLenMachineID       uint8
+	bitLenMachineIDPrefix uint8
+	fieldOrder            FieldOrder
+
+	// sequenceSeed derives the offset of the sequence numbers in each time unit
+	// if Settings.RandomizeSequenceStart is set.
+	randomizeSequence bool
+	sequenceSeed      uint64
+
+	// createdElapsedTime is the elapsed time when the Snooflake was created.
+	// NextIDAt keeps the sequence numbers of the time units before it in backfill.
+	createdElapsedTime int64
+	backfillMutex      sync.Mutex
+	backfill           map[int64]uint32
+
+	// stuckSleeps is the number of the last consecutive sleeps without the clock advancing.
+	stuckSleeps uint32
+
+	// closed is set to 1 by Close.
+	// conflict is set to 1 when Settings.MachineIDHeartbeat reports a conflict.
+	closed    uint32
+	conflict  uint32
+	stop      chan struct{}
+	stopped   chan struct{}
+	closeOnce sync.Once
 }
 
 // NewSnooflake returns a new Snooflake configured with the given Settings.
 // NewSnooflake returns nil in the following cases:
-// - Settings.StartTime is ahead of the current time.
+// - Settings.StartTime, or DefaultStartTime if it is 0, is ahead of the current time.
+// - Settings.StartTime is so old that the Snooflake time overflows.
+// - Settings.TimeUnit is negative.
 // - Settings.MachineID returns an error.
 // - Settings.CheckMachineID returns false.
 func NewSnooflake(st Settings) *Snooflake {
+	sf, _ := NewSnooflakeWithError(st)
+	return sf
+}
+
+// NewSnooflakeWithError is like NewSnooflake but returns an error
+// describing why the Snooflake could not be created:
+// - ErrStartTimeAhead if Settings.StartTime, or DefaultStartTime if it is 0, is ahead of the current time.
+// - ErrOverTimeLimit if the Snooflake time already overflows since Settings.StartTime.
+// - ErrInvalidBitLength if a bit length in Settings is invalid.
+// - ErrInvalidTimeUnit if Settings.TimeUnit is negative.
+// - ErrInvalidInterval if Settings.MachineIDHeartbeatInterval is negative.
+// - ErrInvalidFieldOrder if Settings.FieldOrder is invalid.
+// - ErrSequenceTooLarge if Settings.InitialSequence does not fit in the sequence bits.
+// - The error reading the random seed of Settings.RandomizeSequenceStart, wrapped.
+// - The error returned by Settings.MachineID, wrapped.
+// - ErrMachineIDTooLarge if the machine id or Settings.MachineIDPrefix does not fit in its bits.
+// - ErrInvalidMachineID if Settings.CheckMachineID returns false.
+// - The error returned by Settings.CheckMachineIDContext, wrapped.
+func NewSnooflakeWithError(st Settings) (*Snooflake, error) {
+	return NewSnooflakeContext(context.Background(), st)
+}
+
+// NewSnooflakeContext is like NewSnooflakeWithError but honors the cancellation of ctx
+// while resolving and validating the machine id, which may involve a coordination service.
+// ctx is checked before each call to Settings.MachineID and Settings.CheckMachineID,
+// and passed to Settings.CheckMachineIDContext.
+// If ctx is done, NewSnooflakeContext returns ctx.Err(), wrapped.
+// ctx is not used after the Snooflake is created.
+func NewSnooflakeContext(ctx context.Context, st Settings) (*Snooflake, error) {
 	sf := new(Snooflake)
-	sf.mutex = new(sync.Mutex)
-	sf.sequence = uint16(1<<BitLenSequence - 1)
+	if st.NowFunc == nil {
+		sf.now = time.Now
+	} else {
+		sf.now = st.NowFunc
+	}
+	if st.Sleeper == nil {
+		sf.sleep = time.Sleep
+	} else {
+		sf.sleep = st.Sleeper
+		sf.customSleep = true
+	}
 
-	if st.StartTime.After(time.Now()) {
-		return nil
+	startTime := st.StartTime
+	if startTime.IsZero() {
+		startTime = DefaultStartTime
 	}
-	if st.StartTime.IsZero() {
-		sf.startTime = toSnooflakeTime(time.Date(2014, 9, 1, 0, 0, 0, 0, time.UTC))
+	if startTime.After(sf.now()) {
+		return nil, ErrStartTimeAhead
+	}
+	if st.BitLenSequence == 0 && st.BitLenMachineID == 0 {
+		sf.bitLenSequence = BitLenSequence
+		sf.bitLenMachineID = BitLenMachineID
 	} else {
-		sf.startTime = toSnooflakeTime(st.StartTime)
+		if BitLenTime+int(st.BitLenSequence)+int(st.BitLenMachineID) != 63 || st.BitLenSequence > 16 {
+			return nil, ErrInvalidBitLength
+		}
+		sf.bitLenSequence = st.BitLenSequence
+		sf.bitLenMachineID = st.BitLenMachineID
+	}
+	if st.FieldOrder != TimeSeqMachine && st.FieldOrder != TimeMachineSeq {
+		return nil, ErrInvalidFieldOrder
+	}
+	sf.fieldOrder = st.FieldOrder
+	sf.state = packState(0, 1<<sf.bitLenSequence-1)
+	switch {
+	case st.TimeUnit < 0:
+		return nil, ErrInvalidTimeUnit
+	case st.TimeUnit == 0:
+		sf.timeUnit = snooflakeTimeUnit
+	default:
+		sf.timeUnit = int64(st.TimeUnit)
+	}
+	if st.MachineIDHeartbeatInterval < 0 {
+		return nil, ErrInvalidInterval
+	}
+	sf.clockBackwardThreshold = st.ClockBackwardThreshold
+	sf.clockStuckThreshold = st.ClockStuckThreshold
+	sf.noWait = st.NoWait
+	sf.maxBatch = st.MaxBatch
+	sf.sleepObserver = st.SleepObserver
+	sf.onSequenceOverflow = st.OnSequenceOverflow
+	sf.trace = st.Trace
+	sf.obfuscator = st.Obfuscate
+	sf.startTime = toSnooflakeTime(startTime, sf.timeUnit)
+	sf.onOverflow = st.OnOverflow
+	sf.createdElapsedTime = sf.currentElapsedTime()
+	if sf.createdElapsedTime >= 1<<BitLenTime && sf.onOverflow != OverflowRecycle {
+		return nil, ErrOverTimeLimit
+	}
+	if int(st.InitialSequence) >= 1<<sf.bitLenSequence {
+		return nil, ErrSequenceTooLarge
+	}
+	if st.InitialSequence > 0 {
+		// Pretend that the sequence numbers before InitialSequence are used.
+		sf.state = packState(sf.createdElapsedTime, st.InitialSequence-1)
+	}
+	if st.RandomizeSequenceStart {
+		var seed [8]byte
+		if _, err := rand.Read(seed[:]); err != nil {
+			return nil, fmt.Errorf("sequence seed: %w", err)
+		}
+		sf.randomizeSequence = true
+		sf.sequenceSeed = binary.LittleEndian.Uint64(seed[:])
 	}
 
 	var err error
-	if st.MachineID == nil {
-		sf.machineID, err = lower16BitPrivateIP()
-	} else {
-		sf.machineID, err = st.MachineID()
+	if st.BitLenMachineIDPrefix > 0 && (st.BitLenMachineIDPrefix >= sf.bitLenMachineID || sf.bitLenMachineID > 16) {
+		return nil, ErrInvalidBitLength
 	}
-	if err != nil || (st.CheckMachineID != nil && !st.CheckMachineID(sf.machineID)) {
-		return nil
+	if uint64(st.MachineIDPrefix) >= 1<<st.BitLenMachineIDPrefix {
+		return nil, ErrMachineIDTooLarge
 	}
+	sf.bitLenMachineIDPrefix = st.BitLenMachineIDPrefix
 
-	return sf
+	sf.machineID, err = sf.resolveMachineID(ctx, st)
+	if err != nil {
+		return nil, err
+	}
+
+	if st.MachineIDHeartbeat != nil {
+		interval := st.MachineIDHeartbeatInterval
+		if interval == 0 {
+			interval = defaultHeartbeatInterval
+		}
+		sf.startHeartbeat(st.MachineIDHeartbeat, interval)
+	}
+
+	return sf, nil
+}
+
+// NewDeterministic returns a new Snooflake generating the same sequence of IDs on every run,
+// e.g. for golden-file tests, given the same start time, machine id and clock.
+// It never sleeps; when the sequence is exhausted, the following IDs are borrowed
+// from the next time units as usual but are returned at once, ahead of the clock.
+// For the IDs to stay stable across releases, clock should not depend on how many times it is called,
+// e.g. it should return a fixed time or a time advanced explicitly by the test.
+func NewDeterministic(startTime time.Time, machineID uint16, clock func() time.Time) (*Snooflake, error) {
+	var st Settings
+	st.StartTime = startTime
+	st.NowFunc = clock
+	st.Sleeper = func(time.Duration) {}
+	st.MachineID = func() (uint16, error) { return machineID, nil }
+	return NewSnooflakeWithError(st)
+}
+
+func (sf *Snooflake) resolveMachineID(ctx context.Context, st Settings) (uint16, error) {
+	for retry := 0; ; retry++ {
+		if err := ctx.Err(); err != nil {
+			return 0, fmt.Errorf("machine id: %w", err)
+		}
+
+		var machineID uint16
+		var err error
+		if st.MachineID == nil {
+			machineID, err = lower16BitIP(st.PreferredInterface, st.IPSelector)
+		} else {
+			machineID, err = st.MachineID()
+		}
+		if err != nil {
+			return 0, fmt.Errorf("machine id: %w", err)
+		}
+		bitLenLocal := sf.bitLenMachineID - sf.bitLenMachineIDPrefix
+		if uint64(machineID) >= 1<<bitLenLocal {
+			return 0, ErrMachineIDTooLarge
+		}
+		machineID |= st.MachineIDPrefix << bitLenLocal
+
+		if err := ctx.Err(); err != nil {
+			return 0, fmt.Errorf("machine id: %w", err)
+		}
+		ok := true
+		switch {
+		case st.CheckMachineIDContext != nil:
+			ok, err = st.CheckMachineIDContext(ctx, machineID)
+			if err != nil {
+				return 0, fmt.Errorf("check machine id: %w", err)
+			}
+		case st.CheckMachineID != nil:
+			ok = st.CheckMachineID(machineID)
+		}
+		if ok {
+			return machineID, nil
+		}
+		if retry >= st.MachineIDRetry {
+			return 0, ErrInvalidMachineID
+		}
+	}
 }
 
+// StartTime returns the time since which the Snooflake time is defined as the elapsed time.
+// If Settings.StartTime was 0, it is DefaultStartTime at the creation of the Snooflake.
+// If Settings.OnOverflow is OverflowRecycle, it is the start time of the current epoch.
+func (sf *Snooflake) StartTime() time.Time {
+	return timeFromElapsed(sf.epochStartTime(), 0, time.Duration(sf.timeUnit))
+}
+
+// epochStartTime returns the start time in time units since the Unix epoch,
+// moved forward to the current epoch if Settings.OnOverflow is OverflowRecycle.
+func (sf *Snooflake) epochStartTime() int64 {
+	if sf.onOverflow == OverflowRecycle {
+		return sf.startTime + sf.currentElapsedTime()&^(1<<BitLenTime-1)
+	}
+	return sf.startTime
+}
+
+// MachineID returns the machine id of the Snooflake.
+func (sf *Snooflake) MachineID() uint16 {
+	return sf.machineID
+}
+
+// Config is the effective configuration of a Snooflake after the defaults are applied.
+type Config struct {
+	StartTime       time.Time
+	TimeUnit        time.Duration
+	BitLenTime      uint8
+	BitLenSequence  uint8
+	BitLenMachineID uint8
+	FieldOrder      FieldOrder
+	MachineID       uint16
+}
+
+// Config returns the effective configuration of the Snooflake, e.g. for a diagnostics endpoint.
+// It is safe to call concurrently with NextID.
+func (sf *Snooflake) Config() Config {
+	return Config{
+		StartTime:       sf.StartTime(),
+		TimeUnit:        time.Duration(sf.timeUnit),
+		BitLenTime:      BitLenTime,
+		BitLenSequence:  sf.bitLenSequence,
+		BitLenMachineID: sf.bitLenMachineID,
+		FieldOrder:      sf.fieldOrder,
+		MachineID:       sf.machineID,
+	}
+}
+
+// MaxIDsPerSecond returns how many IDs the Snooflake can generate per second at most,
+// that is, the sequence capacity of a time unit times the time units per second.
+// A rate beyond it makes NextID sleep, and is a sign to shard the load by machine id.
+// With the default settings it is 256000.
+// It is fractional for a time unit longer than the sequence capacity in seconds,
+// e.g. 0.256 for a time unit of 1000 seconds with the default sequence bits.
+func (sf *Snooflake) MaxIDsPerSecond() float64 {
+	return float64(int64(1)<<sf.bitLenSequence) * float64(time.Second) / float64(sf.timeUnit)
+}
+
+// Time returns the time at which the given Snooflake ID was generated, in UTC.
+// The time is truncated to the time unit of the Snooflake.
+// If Settings.OnOverflow is OverflowRecycle, the ID is assumed to be of the current epoch.
+func (sf *Snooflake) Time(id uint64) time.Time {
+	elapsed := int64(id >> (sf.bitLenSequence + sf.bitLenMachineID))
+	return timeFromElapsed(sf.epochStartTime(), elapsed, time.Duration(sf.timeUnit))
+}
+
+// Elapsed returns the Snooflake time of the last generated ID,
+// that is, the elapsed time since the start time in time units.
+// Before any ID is generated, it returns 0, or the time of the state seeded at creation:
+// the creation time if Settings.InitialSequence is positive,
+// or the restored time of the last ID if the Snooflake is created by NewFromState.
+// It is safe to call concurrently with NextID.
+func (sf *Snooflake) Elapsed() int64 {
+	elapsedTime, _ := unpackState(atomic.LoadUint64(&sf.state))
+	if sf.onOverflow == OverflowRecycle {
+		elapsedTime &= 1<<BitLenTime - 1
+	}
+	return elapsedTime
+}
+
+// Sequence returns the sequence number of the last generated ID,
+// or the number of the IDs generated in its time unit minus 1 if Settings.RandomizeSequenceStart is set.
+// A sequence number approaching the maximum means the time unit is nearly saturated,
+// and the following IDs will wait for the next time unit.
+// It is safe to call concurrently with NextID.
+func (sf *Snooflake) Sequence() uint16 {
+	_, sequence := unpackState(atomic.LoadUint64(&sf.state))
+	return sequence
+}
+
+// PeekTime returns the time the next ID generated by NextID would carry, in UTC,
+// without generating it. If the sequence is exhausted in the time unit of the last ID,
+// it is the next time unit borrowed ahead of the clock.
+// The time is truncated to the time unit of the Snooflake.
+// It is safe to call concurrently with NextID, which may consume the time unit in the meantime.
+func (sf *Snooflake) PeekTime() time.Time {
+	elapsedTime, sequence := unpackState(atomic.LoadUint64(&sf.state))
+	if current := sf.currentElapsedTime(); elapsedTime < current {
+		elapsedTime = current
+	} else if sequence == 1<<sf.bitLenSequence-1 {
+		elapsedTime++
+	}
+	return timeFromElapsed(sf.startTime, elapsedTime, time.Duration(sf.timeUnit))
+}
+
+// TimeUntilExhausted returns how long the Snooflake can generate IDs before they overflow the time bits.
+// It returns 0 if the Snooflake time is already over the limit.
+// If Settings.OnOverflow is OverflowRecycle, it returns the time until the next wrap-around.
+func (sf *Snooflake) TimeUntilExhausted() time.Duration {
+	d := MaxTime(sf.StartTime(), time.Duration(sf.timeUnit)).Sub(sf.now())
+	if d < 0 {
+		return 0
+	}
+	return d
+}
+
+// MaxTime returns the time at which a Snooflake with the given start time and time unit
+// can no longer generate IDs because they overflow the time bits.
+// If timeUnit is 0, the default time unit of 1 msec is used.
+func MaxTime(startTime time.Time, timeUnit time.Duration) time.Time {
+	return TimeFromElapsed(startTime, 1<<BitLenTime, timeUnit)
+}
+
+// TimeFromElapsed returns the time elapsed time units after the start time, in UTC,
+// such as the generation time of an ID whose time part is elapsed.
+// If unit is 0, the default time unit of 1 msec is used.
+// Unlike multiplying elapsed by unit, it does not overflow time.Duration for a long time unit.
+func TimeFromElapsed(start time.Time, elapsed uint64, unit time.Duration) time.Time {
+	if unit == 0 {
+		unit = snooflakeTimeUnit
+	}
+
+	// Add the time units in chunks so that a long time unit does not overflow time.Duration.
+	maxN := uint64(math.MaxInt64 / unit)
+	for elapsed > maxN {
+		start = start.Add(time.Duration(maxN) * unit)
+		elapsed -= maxN
+	}
+	return start.Add(time.Duration(elapsed) * unit).UTC()
+}
+
+// NextIDs generates num next unique IDs in ascending order.
+// The IDs are reserved at once even if they span many time units,
+// and NextIDs sleeps at most once until the time unit of the last ID.
+// If the IDs would overflow the time bits, NextIDs returns ErrOverTimeLimit up front
+// without generating any ID, unless Settings.OnOverflow is OverflowRecycle.
+// If another error occurs, NextIDs returns the IDs generated before the error along with it,
+// so every returned ID is valid.
+// NextIDs returns an empty slice for num 0, ErrNegativeCount for negative num,
+// and ErrBatchTooLarge for num above Settings.MaxBatch or MaxBatchLen.
+// The limits are checked before the IDs are allocated.
 func (sf *Snooflake) NextIDs(num int) ([]uint64, error) {
-	sf.mutex.Lock()
-	defer sf.mutex.Unlock()
-	ids := make([]uint64, num)
-	for i := 0; i < num; i++ {
-		id, err := sf.nextID()
+	if err := sf.checkBatch(num); err != nil {
+		return nil, err
+	}
+
+	ids := make([]uint64, 0, num)
+	if num == 0 {
+		return ids, nil
+	}
+
+	elapsedTime, sequence, err := sf.reserveSpan(num)
+	if err != nil {
+		return ids, err
+	}
+
+	maskSequence := uint16(1<<sf.bitLenSequence - 1)
+	for len(ids) < num {
+		id, err := sf.toID(elapsedTime, sequence)
 		if err != nil {
 			return ids, err
 		}
-		ids[i] = id
+		ids = append(ids, id)
+
+		sequence = (sequence + 1) & maskSequence
+		if sequence == 0 {
+			elapsedTime++
+		}
 	}
 	return ids, nil
 }
 
+// Stream returns a channel that receives next unique IDs in ascending order.
+// The channel has a buffer of the given size, so up to size IDs are generated ahead of demand.
+// A negative size is taken as 0.
+// The channel is closed when ctx is done or an error such as ErrOverTimeLimit occurs.
+// With Settings.NoWait, the stream still waits for the next time unit on the exhausted sequence
+// rather than closing, since ErrSequenceExhausted is not an end of the stream.
+func (sf *Snooflake) Stream(ctx context.Context, size int) <-chan uint64 {
+	if size < 0 {
+		size = 0
+	}
+	ch := make(chan uint64, size)
+	go func() {
+		defer close(ch)
+		for {
+			id, err := sf.nextID()
+			if err == ErrSequenceExhausted {
+				sf.WaitForNextUnit()
+				if ctx.Err() != nil {
+					return
+				}
+				continue
+			}
+			if err != nil {
+				return
+			}
+
+			select {
+			case ch <- id:
+			case <-ctx.Done():
+				return
+			}
+		}
+	}()
+	return ch
+}
+
+// WaitForNextUnit blocks until the clock advances past the time unit of the last generated ID,
+// so that the following IDs start with a fresh sequence.
+// Calling it before a known burst avoids sleeping unpredictably in the middle of the burst.
+// It does not block other callers, which may consume the fresh sequence concurrently.
+func (sf *Snooflake) WaitForNextUnit() {
+	elapsedTime, _ := unpackState(atomic.LoadUint64(&sf.state))
+	if overtime := elapsedTime - sf.currentElapsedTime() + 1; overtime > 0 {
+		sf.sleep(sleepTime(overtime, sf.now(), sf.timeUnit))
+	}
+}
+
+// NextIDAtOrAfter generates a next unique ID whose time is not before t,
+// e.g. to schedule an event at a future instant in the order of the IDs.
+// If t is ahead of the clock, it blocks until the clock reaches t and then generates the ID as NextID,
+// so the time of the ID is that of t unless the sequence of the time unit is exhausted by other callers.
+// If t is not ahead of the clock, it is the same as NextID.
+// NextIDAtOrAfter returns ErrOverTimeLimit without waiting if t overflows the time bits
+// unless Settings.OnOverflow is OverflowRecycle, and the errors of NextID otherwise.
+// It waits for t even if Settings.NoWait is set.
+func (sf *Snooflake) NextIDAtOrAfter(t time.Time) (uint64, error) {
+	return sf.NextIDAtOrAfterContext(context.Background(), t)
+}
+
+// NextIDAtOrAfterContext is like NextIDAtOrAfter but stops waiting for t when ctx is done
+// and returns the error of ctx.
+// If Settings.Sleeper is given, ctx is checked only between the sleeps, which it cannot interrupt.
+func (sf *Snooflake) NextIDAtOrAfterContext(ctx context.Context, t time.Time) (uint64, error) {
+	target := elapsedFromTime(sf.startTime, t, time.Duration(sf.timeUnit))
+	if sf.onOverflow != OverflowRecycle && target >= 1<<BitLenTime {
+		return 0, ErrOverTimeLimit
+	}
+	if err := sf.usable(); err != nil {
+		return 0, err
+	}
+
+	for {
+		if err := ctx.Err(); err != nil {
+			return 0, err
+		}
+		d := t.Sub(sf.now())
+		if d <= 0 {
+			break
+		}
+		if err := sf.sleepContext(ctx, d); err != nil {
+			return 0, err
+		}
+	}
+	return sf.nextID()
+}
+
+// sleepContext sleeps for d or until ctx is done, and returns the error of ctx.
+func (sf *Snooflake) sleepContext(ctx context.Context, d time.Duration) error {
+	if sf.customSleep {
+		sf.sleep(d)
+		return ctx.Err()
+	}
+
+	timer := time.NewTimer(d)
+	defer timer.Stop()
+	select {
+	case <-timer.C:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// Resync realigns the Snooflake time with the clock without generating an ID,
+// e.g. after a long process pause such as a laptop sleep or a container freeze.
+// The time units before the current one are marked as used, so Elapsed reports the time unit
+// just before the clock and NextIDAt returns ErrTimeInUse for them.
+// Resync returns the error the next NextID would return because of the generator state or the clock:
+// ErrClosed, ErrMachineIDConflict, ErrClockMovedBackwards, or ErrOverTimeLimit
+// unless Settings.OnOverflow is OverflowRecycle.
+func (sf *Snooflake) Resync() error {
+	if err := sf.usable(); err != nil {
+		return err
+	}
+
+	maskSequence := uint16(1<<sf.bitLenSequence - 1)
+	for {
+		old := atomic.LoadUint64(&sf.state)
+		elapsedTime, _ := unpackState(old)
+
+		current := sf.currentElapsedTime()
+		if sf.movedBackwards(current) {
+			return ErrClockMovedBackwards
+		}
+		if sf.onOverflow != OverflowRecycle && current >= 1<<BitLenTime {
+			return ErrOverTimeLimit
+		}
+		if elapsedTime >= current-1 {
+			return nil
+		}
+
+		if atomic.CompareAndSwapUint64(&sf.state, old, packState(current-1, maskSequence)) {
+			return nil
+		}
+	}
+}
+
+// Healthy reports whether NextID would currently succeed, e.g. for a readiness probe.
+// It returns nil or the error NextID would return because of the generator state or the clock:
+// ErrClosed, ErrMachineIDConflict, ErrClockMovedBackwards, or ErrOverTimeLimit
+// unless Settings.OnOverflow is OverflowRecycle.
+// Healthy consumes no sequence number and never sleeps.
+// It does not report ErrSequenceExhausted of Settings.NoWait, which passes within a time unit.
+func (sf *Snooflake) Healthy() error {
+	if err := sf.usable(); err != nil {
+		return err
+	}
+
+	elapsedTime, sequence := unpackState(atomic.LoadUint64(&sf.state))
+	current := sf.currentElapsedTime()
+	if sf.movedBackwards(current) {
+		return ErrClockMovedBackwards
+	}
+
+	next := current
+	if elapsedTime >= current {
+		next = elapsedTime
+		if sequence == uint16(1<<sf.bitLenSequence-1) {
+			next++
+		}
+	}
+	if sf.onOverflow != OverflowRecycle && next >= 1<<BitLenTime {
+		return ErrOverTimeLimit
+	}
+	return nil
+}
+
 // NextID generates a next unique ID.
-// After the Snooflake time overflows, NextID returns an error.
+// After the Snooflake time overflows, NextID returns ErrOverTimeLimit
+// unless Settings.OnOverflow is OverflowRecycle.
+// If the clock moved backwards beyond Settings.ClockBackwardThreshold, NextID returns ErrClockMovedBackwards.
+// If Settings.MachineIDHeartbeat reported a conflict, NextID returns ErrMachineIDConflict.
+// If Settings.NoWait is set, NextID returns ErrSequenceExhausted instead of sleeping.
+// After Close, NextID returns ErrClosed.
+// Note that an ID may be 0 if the machine id is 0, e.g. after the time wraps around
+// with OverflowRecycle, so check the error, not the ID, for a failure.
 func (sf *Snooflake) NextID() (uint64, error) {
-	sf.mutex.Lock()
-	defer sf.mutex.Unlock()
 	return sf.nextID()
 }
 
-// Not thread safe
+// NextTypedID generates a next unique ID as an ID, with the same errors as NextID.
+// The methods of ID decompose the ID with the default bit lengths and field order.
+func (sf *Snooflake) NextTypedID() (ID, error) {
+	id, err := sf.nextID()
+	return ID(id), err
+}
+
+// Close stops the background activity of sf, such as Settings.MachineIDHeartbeat,
+// and waits for it to finish. After Close, the methods generating IDs return ErrClosed.
+// If sf has no background activity, Close only marks sf as closed.
+// Close always returns nil, and it is safe to call Close more than once.
+func (sf *Snooflake) Close() error {
+	sf.closeOnce.Do(func() {
+		atomic.StoreUint32(&sf.closed, 1)
+		if sf.stop != nil {
+			close(sf.stop)
+			<-sf.stopped
+		}
+	})
+	return nil
+}
+
+// usable returns the error of the generator state preventing ID generation, if any.
+func (sf *Snooflake) usable() error {
+	if atomic.LoadUint32(&sf.closed) != 0 {
+		return ErrClosed
+	}
+	if atomic.LoadUint32(&sf.conflict) != 0 {
+		return ErrMachineIDConflict
+	}
+	return nil
+}
+
 func (sf *Snooflake) nextID() (uint64, error) {
-	const maskSequence = uint16(1<<BitLenSequence - 1)
+	if sf.trace != nil {
+		return sf.tracedNextID()
+	}
+
+	elapsedTime, sequence, _, _, err := sf.reserve(1, true)
+	if err != nil {
+		return 0, err
+	}
+	return sf.toID(elapsedTime, sequence)
+}
+
+func (sf *Snooflake) tracedNextID() (uint64, error) {
+	start := sf.now()
+	elapsedTime, sequence, _, slept, err := sf.reserve(1, true)
+	var id uint64
+	if err == nil {
+		id, err = sf.toID(elapsedTime, sequence)
+	}
+	sf.trace(sf.now().Sub(start), slept)
+	return id, err
+}
+
+// NextIDWithParts is like NextID but also returns the parts of the ID
+// without decomposing it, for callers that need both.
+// If Settings.Obfuscate is set, the parts are those of the ID before obfuscation.
+func (sf *Snooflake) NextIDWithParts() (uint64, Parts, error) {
+	elapsedTime, sequence, _, _, err := sf.reserve(1, true)
+	if err != nil {
+		return 0, Parts{}, err
+	}
+	id, err := sf.toID(elapsedTime, sequence)
+	if err != nil {
+		return 0, Parts{}, err
+	}
+
+	return id, Parts{
+		ID:        id,
+		Time:      uint64(elapsedTime) & (1<<BitLenTime - 1),
+		Sequence:  uint64(sf.sequenceAt(elapsedTime, sequence)),
+		MachineID: uint64(sf.machineID),
+	}, nil
+}
+
+// TryNextID is like NextID but never sleeps.
+// If NextID would sleep because the sequence is exhausted in the current time unit,
+// TryNextID returns false without generating an ID, and the caller can retry, drop or buffer the request.
+// The bool is true if an ID is generated.
+func (sf *Snooflake) TryNextID() (uint64, bool, error) {
+	elapsedTime, sequence, count, _, err := sf.reserve(1, false)
+	if err != nil || count == 0 {
+		return 0, false, err
+	}
+
+	id, err := sf.toID(elapsedTime, sequence)
+	if err != nil {
+		return 0, false, err
+	}
+	return id, true, nil
+}
+
+// MaxBatchLen is the largest number of IDs generated by a single call of NextIDs or Reserve,
+// which keeps the slice of the IDs allocatable on any platform.
+const MaxBatchLen = math.MaxInt32 / 8
+
+// checkBatch returns an error if num IDs cannot be generated by a single call,
+// before the caller allocates the IDs.
+func (sf *Snooflake) checkBatch(num int) error {
+	if num < 0 {
+		return ErrNegativeCount
+	}
+	if num > MaxBatchLen || sf.maxBatch > 0 && num > sf.maxBatch {
+		return ErrBatchTooLarge
+	}
+	if sf.onOverflow != OverflowRecycle && int64(num) > sf.remainingIDs() {
+		return ErrOverTimeLimit
+	}
+	return nil
+}
+
+// remainingIDs returns the number of IDs sf can generate before the time limit,
+// which other callers may consume concurrently.
+func (sf *Snooflake) remainingIDs() int64 {
+	elapsedTime, sequence := unpackState(atomic.LoadUint64(&sf.state))
+	used := int64(sequence) + 1
+	if current := sf.currentElapsedTime(); current > elapsedTime {
+		elapsedTime = current
+		used = 0
+	}
+	if elapsedTime >= 1<<BitLenTime {
+		return 0
+	}
+	return (1<<BitLenTime-elapsedTime)<<sf.bitLenSequence - used
+}
+
+// Reserve is like NextIDs but intended as a reservation primitive:
+// the caller reserves a block of IDs at once and hands them out on its own.
+// The IDs in the same time unit are reserved by a single atomic update
+// instead of one by one.
+// Reserve returns ErrOverTimeLimit up front if the IDs would certainly overflow the time bits
+// unless Settings.OnOverflow is OverflowRecycle, and the other errors of NextIDs.
+func (sf *Snooflake) Reserve(n int) ([]uint64, error) {
+	if err := sf.checkBatch(n); err != nil {
+		return nil, err
+	}
+
+	ids := make([]uint64, 0, n)
+	for len(ids) < n {
+		elapsedTime, sequence, count, _, err := sf.reserve(n-len(ids), true)
+		if err != nil {
+			return ids, err
+		}
+		for i := 0; i < count; i++ {
+			id, err := sf.toID(elapsedTime, sequence+uint16(i))
+			if err != nil {
+				return ids, err
+			}
+			ids = append(ids, id)
+		}
+	}
+	return ids, nil
+}
+
+// reserve reserves up to max consecutive sequence numbers in a time unit
+// with a compare-and-swap loop instead of a lock.
+// It returns the time unit, the first sequence number, the number of reserved sequence numbers
+// and whether it slept.
+// If the sequence is exhausted, the sequence numbers are reserved in the next time unit.
+// If the reserved time unit is ahead of the clock, reserve sleeps until that time unit
+// without blocking other callers.
+// If wait is false, reserve reserves nothing and returns 0 sequence numbers instead of sleeping.
+// If Settings.NoWait is set, it returns ErrSequenceExhausted instead of sleeping.
+func (sf *Snooflake) reserve(max int, wait bool) (int64, uint16, int, bool, error) {
+	if err := sf.usable(); err != nil {
+		return 0, 0, 0, false, err
+	}
+
+	maskSequence := uint16(1<<sf.bitLenSequence - 1)
+
+	for {
+		old := atomic.LoadUint64(&sf.state)
+		elapsedTime, sequence := unpackState(old)
+
+		current := sf.currentElapsedTime()
+		if sf.movedBackwards(current) {
+			return 0, 0, 0, false, ErrClockMovedBackwards
+		}
+
+		overflow := false
+		if elapsedTime < current {
+			elapsedTime = current
+			sequence = 0
+		} else { // elapsedTime >= current
+			sequence = (sequence + 1) & maskSequence
+			if sequence == 0 {
+				elapsedTime++
+				overflow = true
+			}
+		}
+
+		if elapsedTime > current {
+			if !wait {
+				return 0, 0, 0, false, nil
+			}
+			if sf.noWait {
+				return 0, 0, 0, false, ErrSequenceExhausted
+			}
+		}
+
+		count := int(maskSequence-sequence) + 1
+		if count > max {
+			count = max
+		}
+		last := sequence + uint16(count-1)
+
+		if !atomic.CompareAndSwapUint64(&sf.state, old, packState(elapsedTime, last)) {
+			continue
+		}
+		if overflow && sf.onSequenceOverflow != nil {
+			sf.onSequenceOverflow()
+		}
+		// Another caller may have borrowed the time unit ahead of the clock.
+		// Wait for it as well so that no ID is ahead of the clock when returned.
+		slept, err := sf.sleepUntil(elapsedTime, current)
+		if err != nil {
+			return 0, 0, 0, false, err
+		}
+		return elapsedTime, sequence, count, slept, nil
+	}
+}
+
+// reserveSpan reserves n consecutive sequence numbers spanning as many time units as needed
+// with a single compare-and-swap, and sleeps once until the last time unit if it is ahead of the clock.
+// It reserves nothing and returns ErrOverTimeLimit if the last time unit overflows the time bits,
+// or ErrSequenceExhausted if it is ahead of the clock and Settings.NoWait is set.
+// It returns the time unit and the sequence number of the first reserved ID.
+// The following IDs increment the sequence number, and then the time unit when the sequence wraps.
+func (sf *Snooflake) reserveSpan(n int) (int64, uint16, error) {
+	if err := sf.usable(); err != nil {
+		return 0, 0, err
+	}
+
+	maskSequence := uint16(1<<sf.bitLenSequence - 1)
+	capacity := int64(maskSequence) + 1
+
+	for {
+		old := atomic.LoadUint64(&sf.state)
+		elapsedTime, sequence := unpackState(old)
+
+		current := sf.currentElapsedTime()
+		if sf.movedBackwards(current) {
+			return 0, 0, ErrClockMovedBackwards
+		}
+
+		overflows := int64(0)
+		if elapsedTime < current {
+			elapsedTime = current
+			sequence = 0
+		} else { // elapsedTime >= current
+			sequence = (sequence + 1) & maskSequence
+			if sequence == 0 {
+				elapsedTime++
+				overflows++
+			}
+		}
+
+		last := int64(sequence) + int64(n) - 1
+		lastElapsedTime := elapsedTime + last/capacity
+		overflows += lastElapsedTime - elapsedTime
+		// Fail fast instead of generating the IDs before the time limit.
+		if sf.onOverflow != OverflowRecycle && lastElapsedTime >= 1<<BitLenTime {
+			return 0, 0, ErrOverTimeLimit
+		}
+		if sf.noWait && lastElapsedTime > current {
+			return 0, 0, ErrSequenceExhausted
+		}
 
-	current := currentElapsedTime(sf.startTime)
-	if sf.elapsedTime < current {
-		sf.elapsedTime = current
-		sf.sequence = 0
-	} else { // sf.elapsedTime >= current
-		sf.sequence = (sf.sequence + 1) & maskSequence
-		if sf.sequence == 0 {
-			sf.elapsedTime++
-			overtime := sf.elapsedTime - current
-			time.Sleep(sleepTime((overtime)))
+		if !atomic.CompareAndSwapUint64(&sf.state, old, packState(lastElapsedTime, uint16(last%capacity))) {
+			continue
+		}
+		if sf.onSequenceOverflow != nil {
+			for i := int64(0); i < overflows; i++ {
+				sf.onSequenceOverflow()
+			}
+		}
+		if _, err := sf.sleepUntil(lastElapsedTime, current); err != nil {
+			return 0, 0, err
 		}
+		return elapsedTime, sequence, nil
 	}
+}
+
+// movedBackwards reports whether the clock is behind its latest reading
+// by more than Settings.ClockBackwardThreshold.
+func (sf *Snooflake) movedBackwards(current int64) bool {
+	return sf.clockBackwardThreshold > 0 &&
+		time.Duration((sf.observeClock(current)-current)*sf.timeUnit) > sf.clockBackwardThreshold
+}
 
-	return sf.toID()
+// observeClock records current as the latest reading of the clock if it is ahead of the recorded one,
+// and returns the latest reading.
+func (sf *Snooflake) observeClock(current int64) int64 {
+	for {
+		high := atomic.LoadInt64(&sf.clockHigh)
+		if current <= high || atomic.CompareAndSwapInt64(&sf.clockHigh, high, current) {
+			if current > high {
+				return current
+			}
+			return high
+		}
+	}
+}
+
+// sleepUntil sleeps until the time unit elapsedTime if it is ahead of the time unit current,
+// and reports whether it slept.
+// It returns ErrClockStuck if the clock did not advance during more than
+// Settings.ClockStuckThreshold consecutive sleeps.
+func (sf *Snooflake) sleepUntil(elapsedTime, current int64) (bool, error) {
+	overtime := elapsedTime - current
+	if overtime <= 0 {
+		return false, nil
+	}
+
+	now := sf.now()
+	sf.sleep(sleepTime(overtime, now, sf.timeUnit))
+	slept := sf.now().Sub(now)
+	if sf.sleepObserver != nil {
+		sf.sleepObserver(slept)
+	}
+
+	if sf.clockStuckThreshold > 0 {
+		if slept > 0 {
+			atomic.StoreUint32(&sf.stuckSleeps, 0)
+		} else if atomic.AddUint32(&sf.stuckSleeps, 1) > uint32(sf.clockStuckThreshold) {
+			return true, ErrClockStuck
+		}
+	}
+	return true, nil
+}
+
+const stateBitLenSequence = 16
+
+func packState(elapsedTime int64, sequence uint16) uint64 {
+	return uint64(elapsedTime)<<stateBitLenSequence | uint64(sequence)
+}
+
+func unpackState(state uint64) (int64, uint16) {
+	return int64(state >> stateBitLenSequence), uint16(state)
 }
 
 const snooflakeTimeUnit = 1e6 // 1 msec
 
-func toSnooflakeTime(t time.Time) int64 {
-	return t.UTC().UnixNano() / snooflakeTimeUnit
+func toSnooflakeTime(t time.Time, unit int64) int64 {
+	return t.UTC().UnixNano() / unit
+}
+
+// timeFromElapsed returns the time elapsed time units after startTime,
+// which is in time units since the Unix epoch as returned by toSnooflakeTime.
+func timeFromElapsed(startTime, elapsed int64, unit time.Duration) time.Time {
+	return time.Unix(0, (startTime+elapsed)*int64(unit)).UTC()
 }
 
-func currentElapsedTime(startTime int64) int64 {
-	return toSnooflakeTime(time.Now()) - startTime
+// elapsedFromTime is the inverse of timeFromElapsed, truncating t to the time unit.
+func elapsedFromTime(startTime int64, t time.Time, unit time.Duration) int64 {
+	return toSnooflakeTime(t, int64(unit)) - startTime
 }
 
-func sleepTime(overtime int64) time.Duration {
-	return time.Duration(overtime)*1*time.Millisecond -
-		time.Duration(time.Now().UTC().UnixNano()%snooflakeTimeUnit)*time.Nanosecond
+func (sf *Snooflake) currentElapsedTime() int64 {
+	return elapsedFromTime(sf.startTime, sf.now(), time.Duration(sf.timeUnit))
+}
+
+// sleepTime returns the duration from now until the start of the time unit
+// overtime units after the time unit of now, which is when an ID borrowed
+// from that time unit is no longer ahead of the clock.
+// The time units are aligned to the Unix epoch as in toSnooflakeTime.
+// overtime is clamped to at least 1, so the result is always positive,
+// at least up to the next unit boundary and at most overtime units.
+// A zero or negative sleep would make the caller busy-loop.
+func sleepTime(overtime int64, now time.Time, unit int64) time.Duration {
+	if overtime < 1 {
+		overtime = 1
+	}
+
+	// The remainder is negative before the Unix epoch.
+	remainder := now.UnixNano() % unit
+	if remainder < 0 {
+		remainder += unit
+	}
+	return time.Duration(overtime*unit - remainder)
+}
+
+func (sf *Snooflake) toID(elapsedTime int64, sequence uint16) (uint64, error) {
+	sequence = sf.sequenceAt(elapsedTime, sequence)
+	if sf.onOverflow == OverflowRecycle {
+		elapsedTime &= 1<<BitLenTime - 1
+	}
+	var id uint64
+	var err error
+	if sf.fieldOrder == TimeMachineSeq {
+		// Compose the machine id as if it were the sequence number, and vice versa.
+		id, err = composeID(elapsedTime, sf.machineID, sequence, sf.bitLenMachineID, sf.bitLenSequence)
+	} else {
+		id, err = composeID(elapsedTime, sequence, sf.machineID, sf.bitLenSequence, sf.bitLenMachineID)
+	}
+	if err != nil || sf.obfuscator == nil {
+		return id, err
+	}
+	return sf.obfuscator.Encode(id), nil
+}
+
+// sequenceAt returns the sequence number of the ID generated after n IDs in the time unit elapsedTime,
+// which is n unless Settings.RandomizeSequenceStart is set.
+func (sf *Snooflake) sequenceAt(elapsedTime int64, n uint16) uint16 {
+	if !sf.randomizeSequence {
+		return n
+	}
+	offset := uint16(mix64(uint64(elapsedTime) ^ sf.sequenceSeed))
+	return (offset + n) & uint16(1<<sf.bitLenSequence-1)
+}
+
+// Compose returns the Snooflake ID with the given parts, which is the inverse of DecomposeParts.
+// It is useful to build synthetic IDs, e.g. in tests.
+// Compose returns ErrOverTimeLimit, ErrSequenceTooLarge or ErrMachineIDTooLarge
+// if a part does not fit in its bits.
+// Use BitLayout.Compose for other bit lengths.
+func Compose(elapsedTime, sequence, machineID uint64) (uint64, error) {
+	layout := BitLayout{Time: BitLenTime, Sequence: BitLenSequence, MachineID: BitLenMachineID}
+	return layout.Compose(elapsedTime, sequence, machineID)
+}
+
+// ComposeAt returns the Snooflake ID generated at t with the given sequence number and machine id
+// by a Snooflake with the given start time and time unit and the default bit lengths,
+// e.g. to build the golden ID of a test fixture for a known wall-clock time.
+// The time units are aligned to the Unix epoch as by the Snooflake.
+// If unit is 0, the default time unit of 1 msec is used.
+// ComposeAt returns ErrTimeBeforeStart if t is before start, ErrOverTimeLimit if t is after
+// the time limit, ErrInvalidTimeUnit if unit is negative, and the errors of Compose.
+func ComposeAt(t time.Time, start time.Time, unit time.Duration, sequence, machineID uint16) (uint64, error) {
+	switch {
+	case unit < 0:
+		return 0, ErrInvalidTimeUnit
+	case unit == 0:
+		unit = snooflakeTimeUnit
+	}
+
+	elapsedTime := elapsedFromTime(toSnooflakeTime(start, int64(unit)), t, unit)
+	if elapsedTime < 0 {
+		return 0, ErrTimeBeforeStart
+	}
+	return Compose(uint64(elapsedTime), uint64(sequence), uint64(machineID))
 }
 
-func (sf *Snooflake) toID() (uint64, error) {
-	if sf.elapsedTime >= 1<<BitLenTime {
-		return 0, errors.New("over the time limit")
+// composeID packs the parts into an ID.
+// The sequence number and the machine id must fit in the given bit lengths.
+func composeID(elapsedTime int64, sequence, machineID uint16, bitLenSequence, bitLenMachineID uint8) (uint64, error) {
+	if elapsedTime >= 1<<BitLenTime {
+		return 0, ErrOverTimeLimit
 	}
 
-	return uint64(sf.elapsedTime)<<(BitLenSequence+BitLenMachineID) |
-		uint64(sf.sequence)<<BitLenMachineID |
-		uint64(sf.machineID), nil
+	return uint64(elapsedTime)<<(bitLenSequence+bitLenMachineID) |
+		uint64(sequence)<<bitLenMachineID |
+		uint64(machineID), nil
 }
 
-func privateIPv4() (net.IP, error) {
+// PrivateIP returns a private IP address of the host.
+// A private IPv4 address is preferred.
+// If there is none, PrivateIP returns an IPv6 unique local address (fc00::/7),
+// or else an IPv6 link-local address (fe80::/10).
+func PrivateIP() (net.IP, error) {
 	as, err := net.InterfaceAddrs()
 	if err != nil {
 		return nil, err
 	}
+	return privateIP(as)
+}
 
+func privateIP(as []net.Addr) (net.IP, error) {
+	var uniqueLocal, linkLocal net.IP
 	for _, a := range as {
 		ipnet, ok := a.(*net.IPNet)
 		if !ok || ipnet.IP.IsLoopback() {
 			continue
 		}
 
-		ip := ipnet.IP.To4()
-		if isPrivateIPv4(ip) {
-			return ip, nil
+		if ip := ipnet.IP.To4(); ip != nil {
+			if isPrivateIPv4(ip) {
+				return ip, nil
+			}
+			continue
+		}
+
+		ip := ipnet.IP.To16()
+		switch {
+		case uniqueLocal == nil && isUniqueLocalIPv6(ip):
+			uniqueLocal = ip
+		case linkLocal == nil && ip.IsLinkLocalUnicast():
+			linkLocal = ip
 		}
 	}
+
+	if uniqueLocal != nil {
+		return uniqueLocal, nil
+	}
+	if linkLocal != nil {
+		return linkLocal, nil
+	}
 	return nil, errors.New("no private ip address")
 }
 
@@ -173,29 +1403,144 @@ func isPrivateIPv4(ip net.IP) bool {
 		(ip[0] == 10 || ip[0] == 172 && (ip[1] >= 16 && ip[1] < 32) || ip[0] == 192 && ip[1] == 168)
 }
 
-func lower16BitPrivateIP() (uint16, error) {
-	ip, err := privateIPv4()
+func isUniqueLocalIPv6(ip net.IP) bool {
+	return ip != nil && ip[0]&0xfe == 0xfc
+}
+
+// lower16BitIP returns the lower 16 bits of the IP address selected by selector
+// among the addresses of the network interface with the given name.
+// If name is "", the addresses of all the network interfaces are considered.
+// If selector is nil, privateIP is used.
+func lower16BitIP(name string, selector func([]net.Addr) (net.IP, error)) (uint16, error) {
+	var as []net.Addr
+	if name == "" {
+		var err error
+		if as, err = net.InterfaceAddrs(); err != nil {
+			return 0, err
+		}
+	} else {
+		i, err := net.InterfaceByName(name)
+		if err != nil {
+			return 0, err
+		}
+		if as, err = i.Addrs(); err != nil {
+			return 0, err
+		}
+	}
+
+	if selector == nil {
+		selector = privateIP
+	}
+	ip, err := selector(as)
 	if err != nil {
 		return 0, err
 	}
+	if len(ip) < 2 {
+		return 0, fmt.Errorf("invalid ip address %v", ip)
+	}
 
-	return uint16(ip[2])<<8 + uint16(ip[3]), nil
+	return uint16(ip[len(ip)-2])<<8 + uint16(ip[len(ip)-1]), nil
+}
+
+// IsValid reports whether id can be a Snooflake ID, that is, its MSB is 0.
+// An ID with the MSB set is usually a corrupted value, such as a negative int64 misinterpreted as uint64.
+func IsValid(id uint64) bool {
+	return id>>63 == 0
 }
 
 // Decompose returns a set of Snooflake ID parts.
 func Decompose(id uint64) map[string]uint64 {
-	const maskSequence = uint64((1<<BitLenSequence - 1) << BitLenMachineID)
-	const maskMachineID = uint64(1<<BitLenMachineID - 1)
+	return decompose(id, BitLenSequence, BitLenMachineID)
+}
 
-	msb := id >> 63
-	time := id >> (BitLenSequence + BitLenMachineID)
-	sequence := id & maskSequence >> BitLenMachineID
-	machineID := id & maskMachineID
+// Decompose returns a set of parts of the Snooflake ID generated by sf.
+// In addition to the parts returned by the package-level Decompose,
+// it contains "timestamp", the generation time of the ID in Unix msec,
+// and "machine-id-prefix" if Settings.BitLenMachineIDPrefix is not 0.
+func (sf *Snooflake) Decompose(id uint64) map[string]uint64 {
+	var parts map[string]uint64
+	if sf.fieldOrder == TimeMachineSeq {
+		parts = decompose(id, sf.bitLenMachineID, sf.bitLenSequence)
+		parts["sequence"], parts["machine-id"] = parts["machine-id"], parts["sequence"]
+	} else {
+		parts = decompose(id, sf.bitLenSequence, sf.bitLenMachineID)
+	}
+	parts["timestamp"] = uint64(sf.Time(id).UnixNano() / int64(time.Millisecond))
+	if sf.bitLenMachineIDPrefix > 0 {
+		parts["machine-id-prefix"] = parts["machine-id"] >> (sf.bitLenMachineID - sf.bitLenMachineIDPrefix)
+	}
+	return parts
+}
+
+// DecomposeString is like Decompose but formats the parts in decimal, e.g. for logs or JSON,
+// and adds "rfc3339", the generation time of the ID in RFC 3339 with nanoseconds in UTC.
+func (sf *Snooflake) DecomposeString(id uint64) map[string]string {
+	parts := sf.Decompose(id)
+	s := make(map[string]string, len(parts)+1)
+	for k, v := range parts {
+		s[k] = strconv.FormatUint(v, 10)
+	}
+	s["rfc3339"] = sf.Time(id).Format(time.RFC3339Nano)
+	return s
+}
+
+func decompose(id uint64, bitLenSequence, bitLenMachineID uint8) map[string]uint64 {
+	p := decomposeParts(id, bitLenSequence, bitLenMachineID)
 	return map[string]uint64{
-		"id":         id,
-		"msb":        msb,
-		"time":       time,
-		"sequence":   sequence,
-		"machine-id": machineID,
+		"id":         p.ID,
+		"msb":        p.MSB,
+		"time":       p.Time,
+		"sequence":   p.Sequence,
+		"machine-id": p.MachineID,
+	}
+}
+
+// Parts is a set of Snooflake ID parts.
+type Parts struct {
+	ID        uint64
+	MSB       uint64
+	Time      uint64
+	Sequence  uint64
+	MachineID uint64
+}
+
+// DecomposeParts is like Decompose but returns the parts as a struct, without allocation.
+func DecomposeParts(id uint64) Parts {
+	return decomposeParts(id, BitLenSequence, BitLenMachineID)
+}
+
+func decomposeParts(id uint64, bitLenSequence, bitLenMachineID uint8) Parts {
+	_, maskSequence, maskMachineID := masks(63-bitLenSequence-bitLenMachineID, bitLenSequence, bitLenMachineID)
+
+	return Parts{
+		ID:        id,
+		MSB:       id >> 63,
+		Time:      id >> (bitLenSequence + bitLenMachineID),
+		Sequence:  id & maskSequence >> bitLenMachineID,
+		MachineID: id & maskMachineID,
 	}
 }
+
+func masks(bitLenTime, bitLenSequence, bitLenMachineID uint8) (uint64, uint64, uint64) {
+	maskTime := uint64(1<<bitLenTime-1) << (bitLenSequence + bitLenMachineID)
+	maskSequence := uint64(1<<bitLenSequence-1) << bitLenMachineID
+	maskMachineID := uint64(1<<bitLenMachineID - 1)
+	return maskTime, maskSequence, maskMachineID
+}
+
+// ElapsedTime returns the time elapsed between the start time and the generation of the given Snooflake ID.
+// Its granularity is the default Snooflake time unit of 1 msec.
+// Use Snooflake.Time for IDs generated with another Settings.TimeUnit.
+func ElapsedTime(id uint64) time.Duration {
+	return time.Duration(id>>(BitLenSequence+BitLenMachineID)) * snooflakeTimeUnit
+}
+
+// MachineOf returns the machine id of the given Snooflake ID.
+func MachineOf(id uint64) uint16 {
+	return uint16(id & (1<<BitLenMachineID - 1))
+}
+
+// IsFromMachine reports whether the given Snooflake ID was generated by the Snooflake of machineID.
+func IsFromMachine(id uint64, machineID uint16) bool {
+	return MachineOf(id) == machineID
+}
@@ -1,8 +1,13 @@
 package snooflake
 
 import (
+	"context"
+	"errors"
 	"fmt"
 	"runtime"
+	"strconv"
+	"sync"
+	"sync/atomic"
 	"testing"
 	"time"
 
@@ -23,10 +28,12 @@ func init() {
 		panic("snooflake not created")
 	}
 
-	startTime = toSnooflakeTime(st.StartTime)
+	startTime = toSnooflakeTime(st.StartTime, snooflakeTimeUnit)
 
-	ip, _ := lower16BitPrivateIP()
-	machineID = uint64(ip)
+	// Default MachineID returns the lower 16 bits of the private IP address.
+	if ip, err := PrivateIP(); err == nil && len(ip) >= 2 {
+		machineID = uint64(ip[len(ip)-2])<<8 + uint64(ip[len(ip)-1])
+	}
 }
 
 func nextID(t *testing.T) uint64 {
@@ -38,8 +45,11 @@ func nextID(t *testing.T) uint64 {
 }
 
 func TestSnooflakeOnce(t *testing.T) {
-	sleepTime := uint64(50)
-	time.Sleep(time.Duration(sleepTime) * 10 * time.Millisecond)
+	sleepTime := uint64(500)
+	time.Sleep(time.Duration(sleepTime) * time.Millisecond)
+
+	// The tests in the files sorted before this one also take time since the start time.
+	elapsedTime := uint64(currentTime() - startTime)
 
 	id := nextID(t)
 	parts := Decompose(id)
@@ -50,7 +60,7 @@ func TestSnooflakeOnce(t *testing.T) {
 	}
 
 	actualTime := parts["time"]
-	if actualTime < sleepTime || actualTime > sleepTime+1 {
+	if actualTime < sleepTime || actualTime < elapsedTime || actualTime > elapsedTime+10 {
 		t.Errorf("unexpected time: %d", actualTime)
 	}
 
@@ -69,7 +79,7 @@ func TestSnooflakeOnce(t *testing.T) {
 }
 
 func currentTime() int64 {
-	return toSnooflakeTime(time.Now())
+	return toSnooflakeTime(time.Now(), snooflakeTimeUnit)
 }
 
 func TestSnooflakeFor10Sec(t *testing.T) {
@@ -150,6 +160,118 @@ func TestSnooflakeInParallel(t *testing.T) {
 	fmt.Println("number of id:", set.Cardinality())
 }
 
+func TestSnooflakeOrderInParallel(t *testing.T) {
+	var st Settings
+	st.MachineID = func() (uint16, error) { return 1, nil }
+	sf := NewSnooflake(st)
+
+	type generation struct {
+		id            uint64
+		before, after int64
+	}
+
+	const numID = 2000
+	const numGenerator = 64
+	results := make(chan []generation)
+	for i := 0; i < numGenerator; i++ {
+		go func() {
+			gs := make([]generation, 0, numID)
+			for j := 0; j < numID; j++ {
+				var g generation
+				g.before = sf.currentElapsedTime()
+				g.id, _ = sf.NextID()
+				g.after = sf.currentElapsedTime()
+				gs = append(gs, g)
+			}
+			results <- gs
+		}()
+	}
+
+	set := mapset.NewSet()
+	for i := 0; i < numGenerator; i++ {
+		var lastID uint64
+		for _, g := range <-results {
+			if g.id <= lastID || set.Contains(g.id) {
+				t.Fatal("duplicated id")
+			}
+			lastID = g.id
+			set.Add(g.id)
+
+			actualTime := int64(DecomposeParts(g.id).Time)
+			if actualTime < g.before || actualTime > g.after {
+				t.Fatalf("id time %d out of generation time [%d, %d]", actualTime, g.before, g.after)
+			}
+		}
+	}
+}
+
+func TestComposeID(t *testing.T) {
+	elapsedTimes := []int64{0, 1, 0x123456789, 1<<BitLenTime - 1}
+	for bitLenSequence := uint8(0); bitLenSequence <= 16; bitLenSequence++ {
+		bitLenMachineID := 63 - BitLenTime - bitLenSequence
+		maxSequence := uint16(1<<bitLenSequence - 1)
+		maxMachineID := uint16(1<<bitLenMachineID - 1)
+		for _, elapsedTime := range elapsedTimes {
+			for _, sequence := range []uint16{0, 1, maxSequence} {
+				if sequence > maxSequence {
+					continue
+				}
+				for _, machineID := range []uint16{0, 1, maxMachineID} {
+					id, err := composeID(elapsedTime, sequence, machineID, bitLenSequence, bitLenMachineID)
+					if err != nil {
+						t.Fatalf("id not composed: %v", err)
+					}
+
+					parts := decomposeParts(id, bitLenSequence, bitLenMachineID)
+					if parts.MSB != 0 ||
+						parts.Time != uint64(elapsedTime) ||
+						parts.Sequence != uint64(sequence) ||
+						parts.MachineID != uint64(machineID) {
+						t.Errorf("unexpected parts of %d with %d sequence bits: %+v", id, bitLenSequence, parts)
+					}
+				}
+			}
+		}
+	}
+
+	if _, err := composeID(1<<BitLenTime, 0, 0, BitLenSequence, BitLenMachineID); err != ErrOverTimeLimit {
+		t.Errorf("unexpected error: %v", err)
+	}
+}
+
+func TestCompose(t *testing.T) {
+	id, err := Compose(0x0123456789, 0xab, 0xcdef)
+	if err != nil || id != 0x0123456789abcdef {
+		t.Errorf("unexpected id: %x, %v", id, err)
+	}
+
+	testCases := []struct {
+		elapsedTime, sequence, machineID uint64
+		expected                         error
+	}{
+		{1 << BitLenTime, 0, 0, ErrOverTimeLimit},
+		{0, 1 << BitLenSequence, 0, ErrSequenceTooLarge},
+		{0, 0, 1 << BitLenMachineID, ErrMachineIDTooLarge},
+	}
+	for _, tc := range testCases {
+		if _, err := Compose(tc.elapsedTime, tc.sequence, tc.machineID); err != tc.expected {
+			t.Errorf("unexpected error for %+v: %v", tc, err)
+		}
+	}
+}
+
+func TestIsValid(t *testing.T) {
+	if !IsValid(nextID(t)) {
+		t.Errorf("generated id is invalid")
+	}
+	if !IsValid(1<<63 - 1) {
+		t.Errorf("max id is invalid")
+	}
+	if IsValid(1 << 63) {
+		t.Errorf("id with msb is valid")
+	}
+}
+
 func TestNilSnooflake(t *testing.T) {
 	var startInFuture Settings
 	startInFuture.StartTime = time.Now().Add(time.Duration(1) * time.Minute)
@@ -174,18 +296,2017 @@ func TestNilSnooflake(t *testing.T) {
 	}
 }
 
-func pseudoSleep(period time.Duration) {
-	sf.startTime -= int64(period) / snooflakeTimeUnit
+func TestNewSnooflakeWithError(t *testing.T) {
+	var startInFuture Settings
+	startInFuture.StartTime = time.Now().Add(time.Duration(1) * time.Minute)
+	if _, err := NewSnooflakeWithError(startInFuture); err != ErrStartTimeAhead {
+		t.Errorf("snooflake starting in the future")
+	}
+
+	errNoMachineID := errors.New("no machine id")
+	var noMachineID Settings
+	noMachineID.MachineID = func() (uint16, error) {
+		return 0, errNoMachineID
+	}
+	if _, err := NewSnooflakeWithError(noMachineID); !errors.Is(err, errNoMachineID) {
+		t.Errorf("unexpected error: %v", err)
+	}
+
+	var invalidMachineID Settings
+	invalidMachineID.CheckMachineID = func(uint16) bool {
+		return false
+	}
+	if _, err := NewSnooflakeWithError(invalidMachineID); err != ErrInvalidMachineID {
+		t.Errorf("snooflake with invalid machine id")
+	}
+}
+
+func TestStartTimeOverTimeLimit(t *testing.T) {
+	var st Settings
+	st.StartTime = time.Date(1970, 1, 1, 0, 0, 0, 0, time.UTC)
+	st.MachineID = func() (uint16, error) { return 1, nil }
+	if _, err := NewSnooflakeWithError(st); err != ErrOverTimeLimit {
+		t.Errorf("unexpected error: %v", err)
+	}
+
+	st.TimeUnit = 10 * time.Millisecond
+	if _, err := NewSnooflakeWithError(st); err != nil {
+		t.Errorf("unexpected error with longer time unit: %v", err)
+	}
+}
+
+func TestMachineIDRetry(t *testing.T) {
+	var candidate uint16
+	var st Settings
+	st.MachineID = func() (uint16, error) {
+		candidate++
+		return candidate, nil
+	}
+	st.CheckMachineID = func(id uint16) bool {
+		return id == 3
+	}
+
+	st.MachineIDRetry = 1
+	if _, err := NewSnooflakeWithError(st); err != ErrInvalidMachineID {
+		t.Errorf("unexpected error: %v", err)
+	}
+
+	candidate = 0
+	st.MachineIDRetry = 2
+	sf, err := NewSnooflakeWithError(st)
+	if err != nil || sf.MachineID() != 3 {
+		t.Errorf("unexpected machine id: %v", err)
+	}
+}
+
+func TestNewSnooflakeContext(t *testing.T) {
+	type leaseKey struct{}
+
+	var candidate uint16
+	var st Settings
+	st.MachineID = func() (uint16, error) {
+		candidate++
+		return candidate, nil
+	}
+	st.CheckMachineID = func(uint16) bool { return false }
+	st.CheckMachineIDContext = func(ctx context.Context, id uint16) (bool, error) {
+		if ctx.Value(leaseKey{}) == nil {
+			t.Error("context not passed")
+		}
+		return id == 2, nil
+	}
+	st.MachineIDRetry = 2
+
+	ctx := context.WithValue(context.Background(), leaseKey{}, true)
+	sf, err := NewSnooflakeContext(ctx, st)
+	if err != nil || sf.MachineID() != 2 {
+		t.Errorf("unexpected machine id: %v", err)
+	}
+
+	lookupErr := errors.New("etcd unavailable")
+	st.CheckMachineIDContext = func(context.Context, uint16) (bool, error) { return false, lookupErr }
+	if _, err := NewSnooflakeContext(ctx, st); !errors.Is(err, lookupErr) {
+		t.Errorf("unexpected error: %v", err)
+	}
+
+	// The check is canceled by the context between the retries.
+	candidate = 0
+	ctx, cancel := context.WithCancel(context.Background())
+	st.CheckMachineIDContext = func(context.Context, uint16) (bool, error) {
+		cancel()
+		return false, nil
+	}
+	if _, err := NewSnooflakeContext(ctx, st); !errors.Is(err, context.Canceled) {
+		t.Errorf("unexpected error: %v", err)
+	}
+	if candidate != 1 {
+		t.Errorf("unexpected number of candidates: %d", candidate)
+	}
+}
+
+func TestMachineIDPrefix(t *testing.T) {
+	var checked uint16
+	var st Settings
+	st.MachineIDPrefix = 0x5
+	st.BitLenMachineIDPrefix = 4
+	st.MachineID = func() (uint16, error) { return 0x123, nil }
+	st.CheckMachineID = func(machineID uint16) bool {
+		checked = machineID
+		return true
+	}
+	sf, err := NewSnooflakeWithError(st)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if sf.MachineID() != 0x5123 || checked != 0x5123 {
+		t.Errorf("unexpected machine id: %x, %x", sf.MachineID(), checked)
+	}
+
+	id, err := sf.NextID()
+	if err != nil {
+		t.Fatal("id not generated")
+	}
+	parts := sf.Decompose(id)
+	if parts["machine-id"] != 0x5123 || parts["machine-id-prefix"] != 0x5 {
+		t.Errorf("unexpected parts: %v", parts)
+	}
+
+	// Another service with the same machine id does not collide.
+	st.MachineIDPrefix = 0x6
+	other := NewSnooflake(st)
+	if other.MachineID() == sf.MachineID() {
+		t.Errorf("machine ids collide across prefixes")
+	}
+	if _, ok := NewSnooflake(Settings{MachineID: st.MachineID}).Decompose(id)["machine-id-prefix"]; ok {
+		t.Errorf("unexpected prefix without prefix bits")
+	}
+
+	st.MachineID = func() (uint16, error) { return 0x1000, nil }
+	if _, err := NewSnooflakeWithError(st); err != ErrMachineIDTooLarge {
+		t.Errorf("unexpected error for machine id beyond the prefix: %v", err)
+	}
+
+	st.MachineID = func() (uint16, error) { return 1, nil }
+	st.MachineIDPrefix = 0x10
+	if _, err := NewSnooflakeWithError(st); err != ErrMachineIDTooLarge {
+		t.Errorf("unexpected error for too large prefix: %v", err)
+	}
+
+	st.MachineIDPrefix = 1
+	st.BitLenMachineIDPrefix = BitLenMachineID
+	if _, err := NewSnooflakeWithError(st); err != ErrInvalidBitLength {
+		t.Errorf("unexpected error for prefix filling the machine id: %v", err)
+	}
+
+	st.BitLenMachineIDPrefix = 4
+	st.BitLenSequence = 4
+	st.BitLenMachineID = 20
+	if _, err := NewSnooflakeWithError(st); err != ErrInvalidBitLength {
+		t.Errorf("unexpected error for prefix beyond 16 bits: %v", err)
+	}
+}
+
+func TestNewDeterministic(t *testing.T) {
+	startTime := time.Date(2020, 1, 1, 0, 0, 0, 0, time.UTC)
+	generate := func() []uint64 {
+		clock := &fakeClock{now: startTime.Add(time.Second)}
+		sf, err := NewDeterministic(startTime, 7, clock.Now)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		var ids []uint64
+		for i := 0; i < 1000; i++ {
+			id, err := sf.NextID()
+			if err != nil {
+				t.Fatal("id not generated")
+			}
+			ids = append(ids, id)
+			if i%300 == 0 {
+				clock.Add(time.Millisecond)
+			}
+		}
+		return ids
+	}
+
+	ids := generate()
+	if fmt.Sprint(generate()) != fmt.Sprint(ids) {
+		t.Error("ids not reproduced")
+	}
+	if parts := DecomposeParts(ids[len(ids)-1]); parts.Time != 1004 || parts.MachineID != 7 {
+		t.Errorf("unexpected parts of the last id: %+v", parts)
+	}
+}
+
+func TestMachineIDZero(t *testing.T) {
+	clock := &fakeClock{now: time.Date(2020, 1, 1, 0, 0, 0, 0, time.UTC)}
+
+	var checked []uint16
+	var st Settings
+	st.StartTime = clock.Now()
+	st.NowFunc = clock.Now
+	st.MachineID = func() (uint16, error) { return 0, nil }
+	st.CheckMachineID = func(machineID uint16) bool {
+		checked = append(checked, machineID)
+		return true
+	}
+	sf, err := NewSnooflakeWithError(st)
+	if err != nil {
+		t.Fatalf("snooflake not created: %v", err)
+	}
+	if len(checked) != 1 || checked[0] != 0 || sf.MachineID() != 0 {
+		t.Errorf("unexpected machine id checks: %v", checked)
+	}
+
+	clock.Add(10 * time.Millisecond)
+	id, err := sf.NextID()
+	if err != nil {
+		t.Fatal("id not generated")
+	}
+	if parts := DecomposeParts(id); parts != (Parts{ID: id, Time: 10, Sequence: 0, MachineID: 0}) {
+		t.Errorf("unexpected parts: %+v", parts)
+	}
+	if actual := sf.Decompose(id)["machine-id"]; actual != 0 {
+		t.Errorf("unexpected machine id: %d", actual)
+	}
+
+	st.CheckMachineID = func(uint16) bool { return false }
+	if _, err := NewSnooflakeWithError(st); err != ErrInvalidMachineID {
+		t.Errorf("unexpected error: %v", err)
+	}
+}
+
+func TestMachineIDTooLarge(t *testing.T) {
+	var st Settings
+	st.BitLenSequence = 12
+	st.BitLenMachineID = 12
+	st.MachineID = func() (uint16, error) { return 1 << 12, nil }
+	if _, err := NewSnooflakeWithError(st); err != ErrMachineIDTooLarge {
+		t.Errorf("unexpected error: %v", err)
+	}
+
+	st.MachineID = func() (uint16, error) { return 1<<12 - 1, nil }
+	if _, err := NewSnooflakeWithError(st); err != nil {
+		t.Errorf("unexpected error: %v", err)
+	}
+}
+
+func TestStartTime(t *testing.T) {
+	var st Settings
+	st.StartTime = time.Date(2020, 1, 2, 3, 4, 5, 0, time.UTC)
+	st.MachineID = func() (uint16, error) { return 1, nil }
+	if actual := NewSnooflake(st).StartTime(); !actual.Equal(st.StartTime) {
+		t.Errorf("unexpected start time: %v", actual)
+	}
+
+	var noStartTime Settings
+	noStartTime.MachineID = st.MachineID
+	defaultStartTime := time.Date(2014, 9, 1, 0, 0, 0, 0, time.UTC)
+	if actual := NewSnooflake(noStartTime).StartTime(); !actual.Equal(defaultStartTime) {
+		t.Errorf("unexpected default start time: %v", actual)
+	}
+
+	recentStartTime := time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)
+	DefaultStartTime = recentStartTime
+	defer func() { DefaultStartTime = defaultStartTime }()
+	if actual := NewSnooflake(noStartTime).StartTime(); !actual.Equal(recentStartTime) {
+		t.Errorf("unexpected overridden default start time: %v", actual)
+	}
+
+	DefaultStartTime = time.Now().Add(time.Hour)
+	if _, err := NewSnooflakeWithError(noStartTime); err != ErrStartTimeAhead {
+		t.Errorf("unexpected error for default start time ahead: %v", err)
+	}
+}
+
+func TestMachineID(t *testing.T) {
+	var st Settings
+	st.MachineID = func() (uint16, error) { return 0x1234, nil }
+	if actual := NewSnooflake(st).MachineID(); actual != 0x1234 {
+		t.Errorf("unexpected machine id: %d", actual)
+	}
+}
+
+func TestConfig(t *testing.T) {
+	var st Settings
+	st.MachineID = func() (uint16, error) { return 7, nil }
+	sf := NewSnooflake(st)
+
+	expected := Config{
+		StartTime:       DefaultStartTime,
+		TimeUnit:        time.Millisecond,
+		BitLenTime:      BitLenTime,
+		BitLenSequence:  BitLenSequence,
+		BitLenMachineID: BitLenMachineID,
+		MachineID:       7,
+	}
+	if actual := sf.Config(); actual != expected {
+		t.Errorf("unexpected config: %+v", actual)
+	}
+
+	st.StartTime = time.Date(2020, 1, 1, 0, 0, 0, 0, time.UTC)
+	st.TimeUnit = 10 * time.Millisecond
+	st.BitLenSequence = 12
+	st.BitLenMachineID = 12
+	sf = NewSnooflake(st)
+
+	expected = Config{
+		StartTime:       st.StartTime,
+		TimeUnit:        st.TimeUnit,
+		BitLenTime:      BitLenTime,
+		BitLenSequence:  12,
+		BitLenMachineID: 12,
+		MachineID:       7,
+	}
+	if actual := sf.Config(); actual != expected {
+		t.Errorf("unexpected config: %+v", actual)
+	}
+}
+
+func TestMaxIDsPerSecond(t *testing.T) {
+	var st Settings
+	st.MachineID = func() (uint16, error) { return 1, nil }
+	if actual := NewSnooflake(st).MaxIDsPerSecond(); actual != 256000 {
+		t.Errorf("unexpected max ids per second: %v", actual)
+	}
+
+	st.TimeUnit = 10 * time.Millisecond
+	st.BitLenSequence = 12
+	st.BitLenMachineID = 12
+	if actual := NewSnooflake(st).MaxIDsPerSecond(); actual != 409600 {
+		t.Errorf("unexpected max ids per second: %v", actual)
+	}
+
+	st.TimeUnit = 2 * time.Second
+	if actual := NewSnooflake(st).MaxIDsPerSecond(); actual != 2048 {
+		t.Errorf("unexpected max ids per second: %v", actual)
+	}
+
+	st.TimeUnit = 1000 * time.Second
+	st.BitLenSequence = 8
+	st.BitLenMachineID = 16
+	if actual := NewSnooflake(st).MaxIDsPerSecond(); actual != 0.256 {
+		t.Errorf("unexpected max ids per second: %v", actual)
+	}
+}
+
+func TestTime(t *testing.T) {
+	var st Settings
+	st.StartTime = time.Date(2020, 1, 2, 3, 4, 5, 0, time.UTC)
+	st.MachineID = func() (uint16, error) { return 1, nil }
+	sf := NewSnooflake(st)
+
+	elapsed := 1234 * time.Millisecond
+	id := uint64(elapsed/snooflakeTimeUnit) << (BitLenSequence + BitLenMachineID)
+	if actual := ElapsedTime(id); actual != elapsed {
+		t.Errorf("unexpected elapsed time: %v", actual)
+	}
+
+	expected := st.StartTime.Add(elapsed)
+	actual := sf.Time(id)
+	if !actual.Equal(expected) || actual.Location() != time.UTC {
+		t.Errorf("unexpected time: %v", actual)
+	}
+}
+
+func TestTimeUnit(t *testing.T) {
+	var st Settings
+	st.StartTime = time.Now().Add(-time.Second)
+	st.TimeUnit = 10 * time.Millisecond
+	st.MachineID = func() (uint16, error) { return 1, nil }
+	sf := NewSnooflake(st)
+
+	id, err := sf.NextID()
+	if err != nil {
+		t.Fatal("id not generated")
+	}
+	actualTime := Decompose(id)["time"]
+	if actualTime < 100 || actualTime > 101 {
+		t.Errorf("unexpected time: %d", actualTime)
+	}
+
+	if sf.StartTime().After(st.StartTime) || st.StartTime.Sub(sf.StartTime()) >= st.TimeUnit {
+		t.Errorf("unexpected start time: %v", sf.StartTime())
+	}
+	if sf.Time(id).Sub(sf.StartTime()) != time.Duration(actualTime)*st.TimeUnit {
+		t.Errorf("unexpected id time: %v", sf.Time(id))
+	}
+}
+
+func TestTimeUnitDefault(t *testing.T) {
+	var st Settings
+	st.MachineID = func() (uint16, error) { return 1, nil }
+	sf, err := NewSnooflakeWithError(st)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if sf.Config().TimeUnit != time.Millisecond {
+		t.Errorf("unexpected time unit: %v", sf.Config().TimeUnit)
+	}
+
+	st.TimeUnit = -time.Millisecond
+	if _, err := NewSnooflakeWithError(st); err != ErrInvalidTimeUnit {
+		t.Errorf("unexpected error: %v", err)
+	}
+	if NewSnooflake(st) != nil {
+		t.Errorf("snooflake created with negative time unit")
+	}
+}
+
+func TestBitLength(t *testing.T) {
+	var st Settings
+	st.BitLenSequence = 10
+	st.BitLenMachineID = 14
+	st.MachineID = func() (uint16, error) { return 0x2abc, nil }
+	sf, err := NewSnooflakeWithError(st)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var lastID uint64
+	for i := 0; i < 2000; i++ {
+		id, err := sf.NextID()
+		if err != nil {
+			t.Fatal("id not generated")
+		}
+		if id <= lastID {
+			t.Fatal("duplicated id")
+		}
+		lastID = id
+
+		parts := decompose(id, st.BitLenSequence, st.BitLenMachineID)
+		if parts["machine-id"] != 0x2abc {
+			t.Errorf("unexpected machine id: %d", parts["machine-id"])
+		}
+		if parts["sequence"] >= 1<<st.BitLenSequence {
+			t.Errorf("unexpected sequence: %d", parts["sequence"])
+		}
+	}
+
+	invalid := []Settings{
+		{BitLenSequence: 8},
+		{BitLenSequence: 8, BitLenMachineID: 8},
+		{BitLenSequence: 17, BitLenMachineID: 7},
+	}
+	for _, st := range invalid {
+		if _, err := NewSnooflakeWithError(st); err != ErrInvalidBitLength {
+			t.Errorf("unexpected error for %d/%d: %v", st.BitLenSequence, st.BitLenMachineID, err)
+		}
+	}
+}
+
+func TestDecomposeString(t *testing.T) {
+	var st Settings
+	st.StartTime = time.Date(2020, 1, 2, 3, 4, 5, 0, time.UTC)
+	st.MachineID = func() (uint16, error) { return 1, nil }
+	sf := NewSnooflake(st)
+
+	id := uint64(1234)<<24 | uint64(5)<<16 | 6
+	expected := map[string]string{
+		"id":         strconv.FormatUint(id, 10),
+		"msb":        "0",
+		"time":       "1234",
+		"sequence":   "5",
+		"machine-id": "6",
+		"timestamp":  "1577934246234",
+		"rfc3339":    "2020-01-02T03:04:06.234Z",
+	}
+	if actual := sf.DecomposeString(id); fmt.Sprint(actual) != fmt.Sprint(expected) {
+		t.Errorf("unexpected parts: %v", actual)
+	}
+}
+
+func TestComposeAt(t *testing.T) {
+	clock := &fakeClock{now: time.Date(2020, 1, 1, 0, 0, 0, 0, time.UTC)}
+	start := clock.Now()
+
+	var st Settings
+	st.StartTime = start
+	st.TimeUnit = 10 * time.Millisecond
+	st.NowFunc = clock.Now
+	st.MachineID = func() (uint16, error) { return 7, nil }
+	sf := NewSnooflake(st)
+
+	clock.Add(1234*time.Millisecond + 5*time.Millisecond)
+	id, err := sf.NextID()
+	if err != nil {
+		t.Fatal("id not generated")
+	}
+	if golden, err := ComposeAt(clock.Now(), start, st.TimeUnit, 0, 7); err != nil || golden != id {
+		t.Errorf("unexpected golden id: %d, %v, expected %d", golden, err, id)
+	}
+
+	if id, err := ComposeAt(start.Add(time.Second), start, 0, 2, 3); err != nil || id != 1000<<24|2<<16|3 {
+		t.Errorf("unexpected id in default unit: %d, %v", id, err)
+	}
+
+	if _, err := ComposeAt(start.Add(-time.Millisecond), start, 0, 0, 0); err != ErrTimeBeforeStart {
+		t.Errorf("unexpected error before start: %v", err)
+	}
+	if _, err := ComposeAt(MaxTime(start, 0), start, 0, 0, 0); err != ErrOverTimeLimit {
+		t.Errorf("unexpected error after time limit: %v", err)
+	}
+	if _, err := ComposeAt(start, start, -time.Millisecond, 0, 0); err != ErrInvalidTimeUnit {
+		t.Errorf("unexpected error for negative unit: %v", err)
+	}
+	if _, err := ComposeAt(start, start, 0, 1<<BitLenSequence, 0); err != ErrSequenceTooLarge {
+		t.Errorf("unexpected error for large sequence: %v", err)
+	}
+}
+
+func TestMachineOf(t *testing.T) {
+	sf := NewSnooflake(Settings{MachineID: func() (uint16, error) { return 0xabcd, nil }})
+	id, err := sf.NextID()
+	if err != nil {
+		t.Fatal("id not generated")
+	}
+
+	if actual := MachineOf(id); actual != 0xabcd || uint64(actual) != Decompose(id)["machine-id"] {
+		t.Errorf("unexpected machine id: %x", actual)
+	}
+	if !IsFromMachine(id, 0xabcd) || IsFromMachine(id, 0xabce) {
+		t.Errorf("unexpected machine of %d", id)
+	}
+	if MachineOf(1<<64-1) != 1<<16-1 {
+		t.Errorf("unexpected machine id of max uint64: %x", MachineOf(1<<64-1))
+	}
+}
+
+func TestFieldOrder(t *testing.T) {
+	clock := &fakeClock{now: time.Date(2020, 1, 1, 0, 0, 0, 0, time.UTC)}
+
+	var st Settings
+	st.StartTime = clock.Now()
+	st.NowFunc = clock.Now
+	st.FieldOrder = TimeMachineSeq
+	st.MachineID = func() (uint16, error) { return 0xabcd, nil }
+	sf := NewSnooflake(st)
+	clock.Add(10 * time.Millisecond)
+	if sf.Config().FieldOrder != TimeMachineSeq {
+		t.Errorf("unexpected field order: %d", sf.Config().FieldOrder)
+	}
+
+	layout := Layout{Bits: DefaultLayout, Order: TimeMachineSeq}
+	for i := 0; i < 3; i++ {
+		id, parts, err := sf.NextIDWithParts()
+		if err != nil {
+			t.Fatal("id not generated")
+		}
+		if id != uint64(10)<<24|uint64(0xabcd)<<8|uint64(i) {
+			t.Errorf("unexpected id: %x", id)
+		}
+		if actual := DecomposeWith(id, layout); actual != parts {
+			t.Errorf("unexpected parts: %+v", actual)
+		}
+		decomposed := sf.Decompose(id)
+		if decomposed["sequence"] != uint64(i) || decomposed["machine-id"] != 0xabcd || decomposed["time"] != 10 {
+			t.Errorf("unexpected decomposed parts: %v", decomposed)
+		}
+	}
+
+	st.FieldOrder = TimeMachineSeq + 1
+	if _, err := NewSnooflakeWithError(st); err != ErrInvalidFieldOrder {
+		t.Errorf("unexpected error: %v", err)
+	}
+}
+
+func TestInitialSequence(t *testing.T) {
+	clock := &fakeClock{now: time.Date(2020, 1, 1, 0, 0, 0, 0, time.UTC)}
+	start := clock.Now()
+	clock.Add(10 * time.Millisecond)
+
+	var st Settings
+	st.StartTime = start
+	st.NowFunc = clock.Now
+	st.Sleeper = func(d time.Duration) { clock.Add(d) }
+	st.InitialSequence = 1<<BitLenSequence - 2
+	st.MachineID = func() (uint16, error) { return 1, nil }
+	sf := NewSnooflake(st)
+
+	ids, err := sf.NextIDs(3)
+	if err != nil {
+		t.Fatal("ids not generated")
+	}
+	expected := []Parts{
+		{Time: 10, Sequence: 1<<BitLenSequence - 2},
+		{Time: 10, Sequence: 1<<BitLenSequence - 1},
+		{Time: 11, Sequence: 0},
+	}
+	for i, id := range ids {
+		parts := DecomposeParts(id)
+		if parts.Time != expected[i].Time || parts.Sequence != expected[i].Sequence {
+			t.Errorf("unexpected parts: %+v", parts)
+		}
+	}
+
+	st.InitialSequence = 1 << BitLenSequence
+	if _, err := NewSnooflakeWithError(st); err != ErrSequenceTooLarge {
+		t.Errorf("unexpected error: %v", err)
+	}
+}
+
+func TestRandomizeSequenceStart(t *testing.T) {
+	clock := &fakeClock{now: time.Date(2020, 1, 1, 0, 0, 0, 0, time.UTC)}
+
+	var st Settings
+	st.StartTime = clock.Now()
+	st.NowFunc = clock.Now
+	st.Sleeper = func(d time.Duration) { clock.Add(d) }
+	st.RandomizeSequenceStart = true
+	st.MachineID = func() (uint16, error) { return 1, nil }
+	sf := NewSnooflake(st)
+	if !sf.randomizeSequence {
+		t.Fatal("sequence not randomized")
+	}
+	sf.sequenceSeed = 0x0123456789abcdef
+
+	// Each time unit uses all the sequence numbers once, starting at its offset.
+	ids, err := sf.NextIDs(3 << BitLenSequence)
+	if err != nil {
+		t.Fatal("ids not generated")
+	}
+	offsets := make(map[uint64]bool)
+	for i := 0; i < len(ids); i += 1 << BitLenSequence {
+		elapsedTime := DecomposeParts(ids[i]).Time
+		offset := uint64(uint16(mix64(elapsedTime^sf.sequenceSeed)) & (1<<BitLenSequence - 1))
+		offsets[offset] = true
+
+		used := make(map[uint64]bool)
+		for j, id := range ids[i : i+1<<BitLenSequence] {
+			parts := DecomposeParts(id)
+			if parts.Time != elapsedTime || parts.Sequence != (offset+uint64(j))&(1<<BitLenSequence-1) {
+				t.Errorf("unexpected parts: %+v", parts)
+			}
+			used[parts.Sequence] = true
+		}
+		if len(used) != 1<<BitLenSequence {
+			t.Errorf("unexpected number of sequence numbers: %d", len(used))
+		}
+	}
+	if len(offsets) < 2 {
+		t.Errorf("unexpected offsets: %v", offsets)
+	}
+
+	id, parts, err := sf.NextIDWithParts()
+	if err != nil || DecomposeParts(id) != (Parts{ID: id, Time: parts.Time, Sequence: parts.Sequence, MachineID: 1}) {
+		t.Errorf("unexpected parts: %+v, %v", parts, err)
+	}
+}
+
+func TestDecomposeMethod(t *testing.T) {
+	var st Settings
+	st.StartTime = time.Date(2020, 1, 2, 3, 4, 5, 0, time.UTC)
+	st.MachineID = func() (uint16, error) { return 1, nil }
+	sf := NewSnooflake(st)
+
+	id, err := sf.NextID()
+	if err != nil {
+		t.Fatal("id not generated")
+	}
+	parts := sf.Decompose(id)
+	for k, v := range Decompose(id) {
+		if parts[k] != v {
+			t.Errorf("unexpected %s: %d", k, parts[k])
+		}
+	}
+
+	expected := st.StartTime.Add(time.Duration(parts["time"]) * time.Millisecond)
+	if parts["timestamp"] != uint64(expected.UnixNano()/int64(time.Millisecond)) {
+		t.Errorf("unexpected timestamp: %d", parts["timestamp"])
+	}
+}
+
+func TestClockMovedBackwards(t *testing.T) {
+	sf, clock := newFakeClockSnooflake(t)
+	sf.clockBackwardThreshold = 100 * time.Millisecond
+	sf.sleep = clock.Add
+
+	clock.Add(time.Second)
+	if _, err := sf.NextID(); err != nil {
+		t.Fatal("id not generated")
+	}
+
+	clock.Add(-time.Second)
+	if _, err := sf.NextID(); err != ErrClockMovedBackwards {
+		t.Errorf("unexpected error: %v", err)
+	}
+
+	clock.Add(time.Second - 10*time.Millisecond)
+	if _, err := sf.NextID(); err != nil {
+		t.Errorf("unexpected error within threshold: %v", err)
+	}
+}
+
+func TestClockMovedBackwardsWithBatch(t *testing.T) {
+	var st Settings
+	st.ClockBackwardThreshold = 50 * time.Millisecond
+	st.MachineID = func() (uint16, error) { return 1, nil }
+	sf := NewSnooflake(st)
+
+	// The batch borrows hundreds of time units ahead of the clock, which is not a clock moved backwards.
+	done := make(chan error)
+	go func() {
+		_, err := sf.NextIDs(100000)
+		done <- err
+	}()
+	time.Sleep(20 * time.Millisecond)
+
+	if err := sf.Healthy(); err != nil {
+		t.Errorf("unexpected health: %v", err)
+	}
+	if _, err := sf.NextID(); err != nil {
+		t.Errorf("unexpected error: %v", err)
+	}
+	if err := <-done; err != nil {
+		t.Errorf("unexpected error of batch: %v", err)
+	}
+}
+
+func TestClockBackwardWithinThreshold(t *testing.T) {
+	clock := &fakeClock{now: time.Date(2020, 1, 1, 0, 0, 0, 0, time.UTC)}
+
+	var st Settings
+	st.StartTime = clock.Now()
+	st.NowFunc = clock.Now
+	st.Sleeper = clock.Add
+	st.ClockBackwardThreshold = 5 * time.Millisecond
+	st.MachineID = func() (uint16, error) { return 1, nil }
+	sf := NewSnooflake(st)
+
+	clock.Add(10 * time.Millisecond)
+	last, err := sf.NextID()
+	if err != nil {
+		t.Fatal("id not generated")
+	}
+
+	// A regression within the threshold is waited out.
+	clock.Add(-3 * time.Millisecond)
+	id, err := sf.NextID()
+	if err != nil {
+		t.Fatalf("unexpected error within threshold: %v", err)
+	}
+	if id <= last || DecomposeParts(id).Time < 10 {
+		t.Errorf("unexpected parts after wait: %+v", DecomposeParts(id))
+	}
+
+	// Time units borrowed ahead of a clock that did not regress are not counted.
+	sf.sleep = func(time.Duration) {}
+	atomic.StoreUint64(&sf.state, packState(sf.currentElapsedTime()+20, 0))
+	if _, err := sf.NextID(); err != nil {
+		t.Errorf("unexpected error without regression: %v", err)
+	}
+
+	clock.Add(-10 * time.Millisecond)
+	if _, err := sf.NextID(); err != ErrClockMovedBackwards {
+		t.Errorf("unexpected error beyond threshold: %v", err)
+	}
+}
+
+type fakeClock struct {
+	mutex sync.Mutex
+	now   time.Time
+}
+
+func (c *fakeClock) Now() time.Time {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	return c.now
+}
+
+func (c *fakeClock) Add(d time.Duration) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	c.now = c.now.Add(d)
+}
+
+func newFakeClockSnooflake(t *testing.T) (*Snooflake, *fakeClock) {
+	clock := &fakeClock{now: time.Date(2020, 1, 1, 0, 0, 0, 0, time.UTC)}
+
+	var st Settings
+	st.StartTime = clock.Now()
+	st.NowFunc = clock.Now
+	st.MachineID = func() (uint16, error) { return 1, nil }
+	sf, err := NewSnooflakeWithError(st)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return sf, clock
+}
+
+func TestNowFunc(t *testing.T) {
+	sf, clock := newFakeClockSnooflake(t)
+
+	clock.Add(10 * time.Millisecond)
+	for i := 0; i < 1<<BitLenSequence; i++ {
+		id, err := sf.NextID()
+		if err != nil {
+			t.Fatal("id not generated")
+		}
+		parts := DecomposeParts(id)
+		if parts.Time != 10 || parts.Sequence != uint64(i) {
+			t.Fatalf("unexpected parts: %+v", parts)
+		}
+	}
+
+	// The sequence is exhausted, so the next ID borrows the next time unit.
+	id, err := sf.NextID()
+	if err != nil {
+		t.Fatal("id not generated")
+	}
+	if parts := DecomposeParts(id); parts.Time != 11 || parts.Sequence != 0 {
+		t.Errorf("unexpected parts after sleep: %+v", parts)
+	}
+
+	// The sequence is reset when the clock advances.
+	clock.Add(5 * time.Millisecond)
+	id, err = sf.NextID()
+	if err != nil {
+		t.Fatal("id not generated")
+	}
+	if parts := DecomposeParts(id); parts.Time != 15 || parts.Sequence != 0 {
+		t.Errorf("unexpected parts after clock advance: %+v", parts)
+	}
+
+	clock.Add(1<<BitLenTime*time.Millisecond - 15*time.Millisecond - 1)
+	if _, err := sf.NextID(); err != nil {
+		t.Errorf("unexpected error before time limit: %v", err)
+	}
+	clock.Add(1)
+	if _, err := sf.NextID(); err != ErrOverTimeLimit {
+		t.Errorf("unexpected error after time limit: %v", err)
+	}
+}
+
+func TestSleeper(t *testing.T) {
+	clock := &fakeClock{now: time.Date(2020, 1, 1, 0, 0, 0, 0, time.UTC)}
+
+	var slept []time.Duration
+	var st Settings
+	st.StartTime = clock.Now()
+	st.NowFunc = clock.Now
+	st.Sleeper = func(d time.Duration) {
+		slept = append(slept, d)
+		clock.Add(d)
+	}
+	st.MachineID = func() (uint16, error) { return 1, nil }
+	sf := NewSnooflake(st)
+
+	clock.Add(10*time.Millisecond + 300*time.Microsecond)
+	ids, err := sf.NextIDs(1<<BitLenSequence + 1)
+	if err != nil {
+		t.Fatal("ids not generated")
+	}
+	if len(slept) != 1 || slept[0] != 700*time.Microsecond {
+		t.Errorf("unexpected sleeps: %v", slept)
+	}
+	if parts := DecomposeParts(ids[len(ids)-1]); parts.Time != 11 || parts.Sequence != 0 {
+		t.Errorf("unexpected parts: %+v", parts)
+	}
+}
+
+func TestSleepTime(t *testing.T) {
+	units := []int64{int64(snooflakeTimeUnit), int64(3 * time.Millisecond), int64(10 * time.Millisecond), int64(time.Second)}
+	for _, unit := range units {
+		// The bases are at unit boundaries after and before the Unix epoch.
+		bases := []time.Time{
+			time.Unix(0, time.Date(2020, 1, 1, 0, 0, 0, 0, time.UTC).UnixNano()/unit*unit),
+			time.Unix(0, -unit),
+		}
+		offsets := []time.Duration{0, 1, time.Duration(unit * 3 / 10), time.Duration(unit - 1)}
+		for _, base := range bases {
+			for _, offset := range offsets {
+				now := base.Add(offset)
+				for overtime := int64(-1); overtime <= 3; overtime++ {
+					d := sleepTime(overtime, now, unit)
+
+					n := overtime
+					if n < 1 {
+						n = 1
+					}
+					if d <= 0 || d > time.Duration(n*unit) {
+						t.Errorf("unexpected sleep time for %d at %v in unit %v: %v", overtime, now, time.Duration(unit), d)
+					}
+					if now.Add(d).UnixNano()%unit != 0 {
+						t.Errorf("sleep for %d at %v in unit %v not until a unit boundary: %v", overtime, now, time.Duration(unit), d)
+					}
+					if expected := time.Duration(n*unit) - offset; d != expected {
+						t.Errorf("unexpected sleep time for %d at %v in unit %v: %v, expected %v", overtime, now, time.Duration(unit), d, expected)
+					}
+				}
+			}
+		}
+	}
+}
+
+func TestSleepObserver(t *testing.T) {
+	clock := &fakeClock{now: time.Date(2020, 1, 1, 0, 0, 0, 0, time.UTC)}
+
+	var observed []time.Duration
+	var st Settings
+	st.StartTime = clock.Now()
+	st.NowFunc = clock.Now
+	st.Sleeper = func(d time.Duration) { clock.Add(d + 50*time.Microsecond) }
+	st.SleepObserver = func(d time.Duration) { observed = append(observed, d) }
+	st.MachineID = func() (uint16, error) { return 1, nil }
+	sf := NewSnooflake(st)
+
+	clock.Add(10*time.Millisecond + 300*time.Microsecond)
+	if _, err := sf.NextIDs(1 << BitLenSequence); err != nil {
+		t.Fatal("ids not generated")
+	}
+	if len(observed) != 0 {
+		t.Errorf("unexpected sleeps: %v", observed)
+	}
+
+	if _, err := sf.NextIDs(1<<BitLenSequence + 1); err != nil {
+		t.Fatal("ids not generated")
+	}
+	// The batch spanning two time units ahead of the clock sleeps once.
+	expected := []time.Duration{1750 * time.Microsecond}
+	if fmt.Sprint(observed) != fmt.Sprint(expected) {
+		t.Errorf("unexpected sleeps: %v", observed)
+	}
+}
+
+func TestClockStuck(t *testing.T) {
+	clock := &fakeClock{now: time.Date(2020, 1, 1, 0, 0, 0, 0, time.UTC)}
+
+	sleeps := 0
+	var st Settings
+	st.StartTime = clock.Now()
+	st.NowFunc = clock.Now
+	st.Sleeper = func(time.Duration) { sleeps++ }
+	st.ClockStuckThreshold = 3
+	st.MachineID = func() (uint16, error) { return 1, nil }
+	sf := NewSnooflake(st)
+
+	clock.Add(10 * time.Millisecond)
+	if _, err := sf.NextIDs(1 << BitLenSequence); err != nil {
+		t.Fatal("ids not generated")
+	}
+	for i := 0; i < 3; i++ {
+		if _, err := sf.NextIDs(1 << BitLenSequence); err != nil {
+			t.Fatalf("unexpected error within threshold: %v", err)
+		}
+	}
+	if _, err := sf.NextID(); err != ErrClockStuck {
+		t.Errorf("unexpected error: %v", err)
+	}
+	if sleeps != 4 {
+		t.Errorf("unexpected number of sleeps: %d", sleeps)
+	}
+
+	// The clock advancing during a sleep resets the count.
+	sf.sleep = func(d time.Duration) { clock.Add(d) }
+	if _, err := sf.NextIDs(1 << BitLenSequence); err != nil {
+		t.Errorf("unexpected error after the clock advanced: %v", err)
+	}
+	if atomic.LoadUint32(&sf.stuckSleeps) != 0 {
+		t.Errorf("unexpected stuck sleeps: %d", sf.stuckSleeps)
+	}
+}
+
+func TestTrace(t *testing.T) {
+	clock := &fakeClock{now: time.Date(2020, 1, 1, 0, 0, 0, 0, time.UTC)}
+
+	type call struct {
+		d     time.Duration
+		slept bool
+	}
+	var calls []call
+	var st Settings
+	st.StartTime = clock.Now()
+	st.NowFunc = clock.Now
+	st.Sleeper = func(d time.Duration) { clock.Add(d) }
+	st.Trace = func(d time.Duration, slept bool) { calls = append(calls, call{d, slept}) }
+	st.MachineID = func() (uint16, error) { return 1, nil }
+	sf := NewSnooflake(st)
+
+	clock.Add(10*time.Millisecond + 300*time.Microsecond)
+	for i := 0; i < 1<<BitLenSequence+1; i++ {
+		if _, err := sf.NextID(); err != nil {
+			t.Fatal("id not generated")
+		}
+	}
+	if len(calls) != 1<<BitLenSequence+1 {
+		t.Fatalf("unexpected number of calls: %d", len(calls))
+	}
+	for _, c := range calls[:1<<BitLenSequence] {
+		if c != (call{}) {
+			t.Errorf("unexpected call without sleep: %+v", c)
+		}
+	}
+	if c := calls[1<<BitLenSequence]; c != (call{700 * time.Microsecond, true}) {
+		t.Errorf("unexpected call with sleep: %+v", c)
+	}
+
+	sf.Close()
+	if _, err := sf.NextID(); err != ErrClosed {
+		t.Errorf("unexpected error: %v", err)
+	}
+	if len(calls) != 1<<BitLenSequence+2 {
+		t.Errorf("failed call not traced")
+	}
+}
+
+func TestOnSequenceOverflow(t *testing.T) {
+	clock := &fakeClock{now: time.Date(2020, 1, 1, 0, 0, 0, 0, time.UTC)}
+
+	overflows := 0
+	var st Settings
+	st.StartTime = clock.Now()
+	st.NowFunc = clock.Now
+	st.Sleeper = clock.Add
+	st.OnSequenceOverflow = func() { overflows++ }
+	st.MachineID = func() (uint16, error) { return 1, nil }
+	sf := NewSnooflake(st)
+
+	clock.Add(10 * time.Millisecond)
+	if _, err := sf.NextIDs(1 << BitLenSequence); err != nil {
+		t.Fatal("ids not generated")
+	}
+	if overflows != 0 {
+		t.Errorf("unexpected overflows: %d", overflows)
+	}
+
+	if _, err := sf.NextIDs(2<<BitLenSequence + 1); err != nil {
+		t.Fatal("ids not generated")
+	}
+	if overflows != 3 {
+		t.Errorf("unexpected overflows: %d", overflows)
+	}
+}
+
+func TestElapsedAndSequence(t *testing.T) {
+	sf, clock := newFakeClockSnooflake(t)
+	if sf.Elapsed() != 0 {
+		t.Errorf("unexpected initial elapsed time: %d", sf.Elapsed())
+	}
+
+	clock.Add(10 * time.Millisecond)
+	if _, err := sf.NextIDs(100); err != nil {
+		t.Fatal("ids not generated")
+	}
+	if sf.Elapsed() != 10 || sf.Sequence() != 99 {
+		t.Errorf("unexpected elapsed time and sequence: %d, %d", sf.Elapsed(), sf.Sequence())
+	}
+
+	// The state pinned by InitialSequence is reported before any ID.
+	clock = &fakeClock{now: time.Date(2020, 1, 1, 0, 0, 0, 0, time.UTC)}
+	st := Settings{
+		StartTime:       clock.Now().Add(-5 * time.Millisecond),
+		NowFunc:         clock.Now,
+		MachineID:       func() (uint16, error) { return 1, nil },
+		InitialSequence: 3,
+	}
+	sf, err := NewSnooflakeWithError(st)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if sf.Elapsed() != 5 || sf.Sequence() != 2 {
+		t.Errorf("unexpected initial elapsed time and sequence: %d, %d", sf.Elapsed(), sf.Sequence())
+	}
+}
+
+func TestPeekTime(t *testing.T) {
+	sf, clock := newFakeClockSnooflake(t)
+	start := clock.Now()
+
+	clock.Add(10*time.Millisecond + 300*time.Microsecond)
+	if actual := sf.PeekTime(); !actual.Equal(start.Add(10 * time.Millisecond)) {
+		t.Errorf("unexpected time before any id: %v", actual)
+	}
+
+	for i := 0; i < 1<<BitLenSequence-1; i++ {
+		if _, err := sf.NextID(); err != nil {
+			t.Fatal("id not generated")
+		}
+	}
+	state := atomic.LoadUint64(&sf.state)
+	if actual := sf.PeekTime(); !actual.Equal(start.Add(10 * time.Millisecond)) {
+		t.Errorf("unexpected time in the current unit: %v", actual)
+	}
+
+	id, err := sf.NextID()
+	if err != nil {
+		t.Fatal("id not generated")
+	}
+	if !sf.Time(id).Equal(start.Add(10 * time.Millisecond)) {
+		t.Errorf("unexpected id time: %v", sf.Time(id))
+	}
+	if atomic.LoadUint64(&sf.state) == state {
+		t.Errorf("state not advanced by NextID")
+	}
+
+	// The exhausted sequence borrows the next time unit.
+	state = atomic.LoadUint64(&sf.state)
+	peeked := sf.PeekTime()
+	if !peeked.Equal(start.Add(11 * time.Millisecond)) {
+		t.Errorf("unexpected time on exhausted sequence: %v", peeked)
+	}
+	if atomic.LoadUint64(&sf.state) != state {
+		t.Errorf("state mutated by PeekTime")
+	}
+	sf.sleep = func(d time.Duration) { clock.Add(d) }
+	if id, err := sf.NextID(); err != nil || !sf.Time(id).Equal(peeked) {
+		t.Errorf("unexpected next id time: %v, %v", sf.Time(id), err)
+	}
+}
+
+func TestWaitForNextUnit(t *testing.T) {
+	var st Settings
+	st.TimeUnit = 10 * time.Millisecond
+	st.MachineID = func() (uint16, error) { return 1, nil }
+	sf := NewSnooflake(st)
+
+	for i := 0; i < 10; i++ {
+		last, err := sf.NextID()
+		if err != nil {
+			t.Fatal("id not generated")
+		}
+		sf.WaitForNextUnit()
+		id, err := sf.NextID()
+		if err != nil {
+			t.Fatal("id not generated")
+		}
+
+		if DecomposeParts(id).Time <= DecomposeParts(last).Time || DecomposeParts(id).Sequence != 0 {
+			t.Errorf("unexpected parts after wait: %+v", DecomposeParts(id))
+		}
+	}
+}
+
+func TestResync(t *testing.T) {
+	sf, clock := newFakeClockSnooflake(t)
+	sf.clockBackwardThreshold = 100 * time.Millisecond
+
+	if _, err := sf.NextID(); err != nil {
+		t.Fatal("id not generated")
+	}
+
+	// Pretend that the process was paused for an hour.
+	clock.Add(time.Hour)
+	if err := sf.Resync(); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	current := sf.currentElapsedTime()
+	if sf.Elapsed() != current-1 {
+		t.Errorf("unexpected elapsed time: %d", sf.Elapsed())
+	}
+
+	id, err := sf.NextID()
+	if err != nil {
+		t.Fatal("id not generated")
+	}
+	if parts := DecomposeParts(id); parts.Time != uint64(current) || parts.Sequence != 0 {
+		t.Errorf("unexpected parts after resync: %+v", parts)
+	}
+
+	// A resync within the current time unit keeps the state.
+	if err := sf.Resync(); err != nil || sf.Elapsed() != current || sf.Sequence() != 0 {
+		t.Errorf("unexpected state: %d, %d, %v", sf.Elapsed(), sf.Sequence(), err)
+	}
+
+	clock.Add(-time.Second)
+	if err := sf.Resync(); err != ErrClockMovedBackwards {
+		t.Errorf("unexpected error: %v", err)
+	}
+	clock.Add(time.Second)
+
+	clock.Add((1 << BitLenTime) * time.Millisecond)
+	if err := sf.Resync(); err != ErrOverTimeLimit {
+		t.Errorf("unexpected error over time limit: %v", err)
+	}
+
+	sf.Close()
+	if err := sf.Resync(); err != ErrClosed {
+		t.Errorf("unexpected error after close: %v", err)
+	}
+}
+
+func TestHealthy(t *testing.T) {
+	sf, clock := newFakeClockSnooflake(t)
+	sf.clockBackwardThreshold = 100 * time.Millisecond
+	sf.sleep = clock.Add
+
+	if _, err := sf.NextID(); err != nil {
+		t.Fatal("id not generated")
+	}
+	state := atomic.LoadUint64(&sf.state)
+	if err := sf.Healthy(); err != nil {
+		t.Errorf("unexpected error: %v", err)
+	}
+	if atomic.LoadUint64(&sf.state) != state {
+		t.Error("sequence number consumed")
+	}
+
+	// Healthy is safe to call during ID generation.
+	var wg sync.WaitGroup
+	for i := 0; i < 4; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for j := 0; j < 100; j++ {
+				if err := sf.Healthy(); err != nil {
+					t.Errorf("unexpected error: %v", err)
+				}
+			}
+		}()
+	}
+	if _, err := sf.NextIDs(1000); err != nil {
+		t.Errorf("unexpected error: %v", err)
+	}
+	wg.Wait()
+
+	current := sf.currentElapsedTime()
+	clock.Add(-time.Second)
+	if err := sf.Healthy(); err != ErrClockMovedBackwards {
+		t.Errorf("unexpected error: %v", err)
+	}
+	clock.Add(time.Second)
+
+	// The sequence is exhausted in the last time unit.
+	clock.Add((1<<BitLenTime - 1 - time.Duration(current)) * time.Millisecond)
+	atomic.StoreUint64(&sf.state, packState(1<<BitLenTime-1, 1<<BitLenSequence-1))
+	if err := sf.Healthy(); err != ErrOverTimeLimit {
+		t.Errorf("unexpected error over time limit: %v", err)
+	}
+	if _, err := sf.NextID(); err != ErrOverTimeLimit {
+		t.Errorf("unexpected error of NextID: %v", err)
+	}
+
+	sf.Close()
+	if err := sf.Healthy(); err != ErrClosed {
+		t.Errorf("unexpected error after close: %v", err)
+	}
+}
+
+func TestNextIDAtOrAfter(t *testing.T) {
+	clock := &fakeClock{now: time.Date(2020, 1, 1, 0, 0, 0, 0, time.UTC)}
+	start := clock.Now()
+
+	var st Settings
+	st.StartTime = start
+	st.NowFunc = clock.Now
+	st.Sleeper = func(d time.Duration) { clock.Add(d) }
+	st.NoWait = true
+	st.MachineID = func() (uint16, error) { return 1, nil }
+	sf := NewSnooflake(st)
+
+	id, err := sf.NextIDAtOrAfter(start.Add(50 * time.Millisecond))
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if parts := DecomposeParts(id); parts.Time != 50 || parts.Sequence != 0 {
+		t.Errorf("unexpected parts: %+v", parts)
+	}
+	if sf.currentElapsedTime() != 50 {
+		t.Errorf("unexpected clock: %v", clock.Now())
+	}
+
+	// A time in the past is the same as NextID.
+	id, err = sf.NextIDAtOrAfter(start)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if parts := DecomposeParts(id); parts.Time != 50 || parts.Sequence != 1 {
+		t.Errorf("unexpected parts: %+v", parts)
+	}
+
+	if _, err := sf.NextIDAtOrAfter(start.Add((1 << BitLenTime) * time.Millisecond)); err != ErrOverTimeLimit {
+		t.Errorf("unexpected error beyond the time limit: %v", err)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	if _, err := sf.NextIDAtOrAfterContext(ctx, start.Add(time.Second)); err != context.Canceled {
+		t.Errorf("unexpected error after cancel: %v", err)
+	}
+	if sf.currentElapsedTime() != 50 {
+		t.Errorf("unexpected clock after cancel: %v", clock.Now())
+	}
+}
+
+func TestNextIDAtOrAfterContext(t *testing.T) {
+	sf := NewSnooflake(Settings{MachineID: func() (uint16, error) { return 1, nil }})
+
+	// The context interrupts the wait of the default sleeper.
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+	defer cancel()
+	begin := time.Now()
+	if _, err := sf.NextIDAtOrAfterContext(ctx, begin.Add(time.Hour)); err != context.DeadlineExceeded {
+		t.Errorf("unexpected error: %v", err)
+	}
+	if elapsed := time.Since(begin); elapsed > time.Second {
+		t.Errorf("wait not interrupted: %v", elapsed)
+	}
+
+	target := time.Now().Add(20 * time.Millisecond)
+	id, err := sf.NextIDAtOrAfterContext(context.Background(), target)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if actual := sf.Time(id); actual.Before(target.Truncate(time.Millisecond)) || time.Now().Before(target) {
+		t.Errorf("id before the target: %v < %v", actual, target)
+	}
+}
+
+func TestNextIDsOverTimeLimit(t *testing.T) {
+	sf, clock := newFakeClockSnooflake(t)
+	clock.Add((1<<BitLenTime - 1) * time.Millisecond)
+
+	sf.sleep = func(time.Duration) { t.Error("unexpected sleep") }
+
+	// The batch fails up front without consuming the last time unit.
+	ids, err := sf.NextIDs(300)
+	if err != ErrOverTimeLimit || len(ids) != 0 {
+		t.Errorf("unexpected result: %d ids, %v", len(ids), err)
+	}
+	if sf.Elapsed() != 0 {
+		t.Errorf("unexpected elapsed time: %d", sf.Elapsed())
+	}
+
+	ids, err = sf.NextIDs(1 << BitLenSequence)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	for i, id := range ids {
+		if parts := DecomposeParts(id); parts.Time != 1<<BitLenTime-1 || parts.Sequence != uint64(i) {
+			t.Errorf("unexpected parts: %+v", parts)
+		}
+	}
+
+	if ids, err := sf.NextIDs(1); err != ErrOverTimeLimit || len(ids) != 0 {
+		t.Errorf("unexpected result: %d ids, %v", len(ids), err)
+	}
+}
+
+func TestNextIDsHugeCount(t *testing.T) {
+	sf, clock := newFakeClockSnooflake(t)
+
+	// The count is rejected before the IDs are allocated.
+	for _, num := range []int{MaxBatchLen + 1, 1 << 62, 1<<63 - 1} {
+		if ids, err := sf.NextIDs(num); err != ErrBatchTooLarge || ids != nil {
+			t.Errorf("unexpected result for %d: %d ids, %v", num, len(ids), err)
+		}
+		if ids, err := sf.Reserve(num); err != ErrBatchTooLarge || ids != nil {
+			t.Errorf("unexpected reservation for %d: %d ids, %v", num, len(ids), err)
+		}
+	}
+
+	// Near the time limit, a count within MaxBatchLen exceeds the remaining capacity.
+	clock.Add((1<<BitLenTime - 10) * time.Millisecond)
+	num := 10<<BitLenSequence + 1
+	if ids, err := sf.NextIDs(num); err != ErrOverTimeLimit || ids != nil {
+		t.Errorf("unexpected result: %d ids, %v", len(ids), err)
+	}
+	if ids, err := sf.Reserve(num); err != ErrOverTimeLimit || ids != nil {
+		t.Errorf("unexpected reservation: %d ids, %v", len(ids), err)
+	}
+	if sf.Elapsed() != 0 {
+		t.Errorf("unexpected elapsed time: %d", sf.Elapsed())
+	}
+}
+
+func TestMaxBatch(t *testing.T) {
+	sf, clock := newFakeClockSnooflake(t)
+	sf.maxBatch = 10
+	sf.sleep = clock.Add
+
+	ids, err := sf.NextIDs(10)
+	if err != nil || len(ids) != 10 {
+		t.Fatalf("unexpected result: %d ids, %v", len(ids), err)
+	}
+
+	// The batches above the cap fail without consuming any sequence number.
+	if ids, err := sf.NextIDs(11); err != ErrBatchTooLarge || ids != nil {
+		t.Errorf("unexpected result: %d ids, %v", len(ids), err)
+	}
+	if ids, err := sf.Reserve(1 << 30); err != ErrBatchTooLarge || ids != nil {
+		t.Errorf("unexpected result: %d ids, %v", len(ids), err)
+	}
+	if sf.Sequence() != 9 {
+		t.Errorf("unexpected sequence: %d", sf.Sequence())
+	}
+
+	// The reader stays within the cap by returning a short read.
+	p := make([]byte, 8*20)
+	if n, err := sf.Reader().Read(p); err != nil || n != 8*10 {
+		t.Errorf("unexpected read: %d, %v", n, err)
+	}
+}
+
+func TestOverflowRecycle(t *testing.T) {
+	clock := &fakeClock{now: time.Date(2020, 1, 1, 0, 0, 0, 0, time.UTC)}
+
+	var st Settings
+	st.StartTime = clock.Now()
+	st.OnOverflow = OverflowRecycle
+	st.NowFunc = clock.Now
+	st.Sleeper = clock.Add
+	st.MachineID = func() (uint16, error) { return 1, nil }
+	sf := NewSnooflake(st)
+
+	clock.Add((1<<BitLenTime - 1) * time.Millisecond)
+	ids, err := sf.NextIDs(300)
+	if err != nil {
+		t.Fatalf("ids not generated: %v", err)
+	}
+	for i, id := range ids {
+		expected := Parts{ID: id, Time: 1<<BitLenTime - 1, Sequence: uint64(i), MachineID: 1}
+		if i >= 1<<BitLenSequence {
+			expected.Time = 0
+			expected.Sequence = uint64(i - 1<<BitLenSequence)
+		}
+		if parts := DecomposeParts(id); parts != expected {
+			t.Errorf("unexpected parts: %+v", parts)
+		}
+	}
+
+	expectedStartTime := st.StartTime.Add(1 << BitLenTime * time.Millisecond)
+	if !sf.StartTime().Equal(expectedStartTime) {
+		t.Errorf("unexpected start time: %v", sf.StartTime())
+	}
+	if !sf.Time(ids[len(ids)-1]).Equal(expectedStartTime) {
+		t.Errorf("unexpected time: %v", sf.Time(ids[len(ids)-1]))
+	}
+	if sf.Elapsed() != 0 {
+		t.Errorf("unexpected elapsed time: %d", sf.Elapsed())
+	}
+
+	st.StartTime = clock.Now().Add(-(1<<BitLenTime + 5) * time.Millisecond)
+	sf, err = NewSnooflakeWithError(st)
+	if err != nil {
+		t.Fatalf("snooflake not created: %v", err)
+	}
+	id, err := sf.NextID()
+	if err != nil || DecomposeParts(id).Time != 5 {
+		t.Errorf("unexpected id: %d, %v", id, err)
+	}
+}
+
+func TestNextIDsSpan(t *testing.T) {
+	clock := &fakeClock{now: time.Date(2020, 1, 1, 0, 0, 0, 0, time.UTC)}
+
+	var slept []time.Duration
+	overflows := 0
+	var st Settings
+	st.StartTime = clock.Now()
+	st.NowFunc = clock.Now
+	st.Sleeper = func(d time.Duration) {
+		slept = append(slept, d)
+		clock.Add(d)
+	}
+	st.OnSequenceOverflow = func() { overflows++ }
+	st.MachineID = func() (uint16, error) { return 1, nil }
+	sf := NewSnooflake(st)
+
+	clock.Add(10*time.Millisecond + 300*time.Microsecond)
+	if _, err := sf.NextIDs(100); err != nil {
+		t.Fatal("ids not generated")
+	}
+
+	const num = 100000
+	ids, err := sf.NextIDs(num)
+	if err != nil || len(ids) != num {
+		t.Fatalf("ids not generated: %d, %v", len(ids), err)
+	}
+	for i, id := range ids {
+		index := uint64(100 + i)
+		expected := Parts{ID: id, Time: 10 + index>>BitLenSequence, Sequence: index & (1<<BitLenSequence - 1), MachineID: 1}
+		if parts := DecomposeParts(id); parts != expected {
+			t.Fatalf("unexpected parts: %+v", parts)
+		}
+	}
+
+	lastTime := uint64(10 + (100+num-1)>>BitLenSequence)
+	if len(slept) != 1 || slept[0] != time.Duration(lastTime-10)*time.Millisecond-300*time.Microsecond {
+		t.Errorf("unexpected sleeps: %v", slept)
+	}
+	if uint64(sf.currentElapsedTime()) != lastTime {
+		t.Errorf("unexpected clock after the batch: %d", sf.currentElapsedTime())
+	}
+	if overflows != int(lastTime-10) {
+		t.Errorf("unexpected overflows: %d", overflows)
+	}
+
+	id, err := sf.NextID()
+	if err != nil || id <= ids[len(ids)-1] {
+		t.Errorf("unexpected next id: %d, %v", id, err)
+	}
+}
+
+func TestNextIDsCount(t *testing.T) {
+	sf, _ := newFakeClockSnooflake(t)
+
+	ids, err := sf.NextIDs(0)
+	if err != nil || ids == nil || len(ids) != 0 {
+		t.Errorf("unexpected result for 0: %v, %v", ids, err)
+	}
+
+	ids, err = sf.NextIDs(-1)
+	if err != ErrNegativeCount || ids != nil {
+		t.Errorf("unexpected result for -1: %v, %v", ids, err)
+	}
+
+	ids, err = sf.Reserve(-1)
+	if err != ErrNegativeCount || ids != nil {
+		t.Errorf("unexpected result of Reserve for -1: %v, %v", ids, err)
+	}
+}
+
+func TestStream(t *testing.T) {
+	var st Settings
+	st.MachineID = func() (uint16, error) { return 1, nil }
+	sf := NewSnooflake(st)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	ch := sf.Stream(ctx, 10)
+	var lastID uint64
+	for i := 0; i < 1000; i++ {
+		id := <-ch
+		if id <= lastID {
+			t.Fatal("duplicated id")
+		}
+		lastID = id
+	}
+
+	cancel()
+	for range ch {
+	}
+}
+
+func TestStreamOverTimeLimit(t *testing.T) {
+	sf, clock := newFakeClockSnooflake(t)
+	clock.Add((1<<BitLenTime - 1) * time.Millisecond)
+
+	numID := 0
+	for range sf.Stream(context.Background(), 0) {
+		numID++
+	}
+	if numID != 1<<BitLenSequence {
+		t.Errorf("unexpected number of ids: %d", numID)
+	}
+}
+
+func TestStreamNoWait(t *testing.T) {
+	sf, clock := newFakeClockSnooflake(t)
+	sf.sleep = clock.Add
+	sf.noWait = true
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	ch := sf.Stream(ctx, -1)
+	var lastID uint64
+	for i := 0; i < 3<<BitLenSequence; i++ {
+		id, ok := <-ch
+		if !ok {
+			t.Fatalf("stream closed after %d ids", i)
+		}
+		if id <= lastID {
+			t.Fatal("duplicated id")
+		}
+		lastID = id
+	}
+}
+
+func TestNextIDWithParts(t *testing.T) {
+	sf, clock := newFakeClockSnooflake(t)
+	clock.Add(10 * time.Millisecond)
+
+	for i := 0; i < 10; i++ {
+		id, parts, err := sf.NextIDWithParts()
+		if err != nil {
+			t.Fatal("id not generated")
+		}
+		expected := Parts{ID: id, Time: 10, Sequence: uint64(i), MachineID: 1}
+		if parts != expected || DecomposeParts(id) != expected {
+			t.Errorf("unexpected parts: %+v", parts)
+		}
+	}
+
+	o := NewObfuscator(42)
+	var st Settings
+	st.StartTime = clock.Now()
+	st.NowFunc = clock.Now
+	st.MachineID = func() (uint16, error) { return 1, nil }
+	st.BitLenSequence = 12
+	st.BitLenMachineID = 12
+	st.Obfuscate = o
+	sf = NewSnooflake(st)
+
+	clock.Add(5 * time.Millisecond)
+	id, parts, err := sf.NextIDWithParts()
+	if err != nil {
+		t.Fatal("id not generated")
+	}
+	expected := Parts{ID: id, Time: 5, Sequence: 0, MachineID: 1}
+	if parts != expected {
+		t.Errorf("unexpected parts: %+v", parts)
+	}
+	if actual := decomposeParts(o.Decode(id), 12, 12); actual.Time != 5 || actual.Sequence != 0 || actual.MachineID != 1 {
+		t.Errorf("unexpected decoded parts: %+v", actual)
+	}
+
+	sf.Close()
+	if _, _, err := sf.NextIDWithParts(); err != ErrClosed {
+		t.Errorf("unexpected error: %v", err)
+	}
+}
+
+func TestTryNextID(t *testing.T) {
+	sf, clock := newFakeClockSnooflake(t)
+	sf.sleep = func(time.Duration) { t.Error("unexpected sleep") }
+
+	clock.Add(10 * time.Millisecond)
+	for i := 0; i < 1<<BitLenSequence; i++ {
+		id, ok, err := sf.TryNextID()
+		if err != nil || !ok {
+			t.Fatalf("id not generated: %v", err)
+		}
+		if parts := DecomposeParts(id); parts.Time != 10 || parts.Sequence != uint64(i) {
+			t.Errorf("unexpected parts: %+v", parts)
+		}
+	}
+
+	id, ok, err := sf.TryNextID()
+	if err != nil || ok || id != 0 {
+		t.Errorf("unexpected result on exhausted sequence: %d, %t, %v", id, ok, err)
+	}
+	if sf.Elapsed() != 10 || sf.Sequence() != 1<<BitLenSequence-1 {
+		t.Errorf("unexpected state: %d, %d", sf.Elapsed(), sf.Sequence())
+	}
+
+	clock.Add(time.Millisecond)
+	id, ok, err = sf.TryNextID()
+	if err != nil || !ok {
+		t.Fatalf("id not generated: %v", err)
+	}
+	if parts := DecomposeParts(id); parts.Time != 11 || parts.Sequence != 0 {
+		t.Errorf("unexpected parts: %+v", parts)
+	}
+
+	sf.Close()
+	if _, ok, err := sf.TryNextID(); err != ErrClosed || ok {
+		t.Errorf("unexpected result after close: %t, %v", ok, err)
+	}
+}
+
+func TestNoWait(t *testing.T) {
+	clock := &fakeClock{now: time.Date(2020, 1, 1, 0, 0, 0, 0, time.UTC)}
+
+	var st Settings
+	st.StartTime = clock.Now()
+	st.NowFunc = clock.Now
+	st.Sleeper = func(time.Duration) { t.Error("unexpected sleep") }
+	st.NoWait = true
+	st.MachineID = func() (uint16, error) { return 1, nil }
+	sf := NewSnooflake(st)
+
+	// Exhaust the time unit under the frozen clock.
+	clock.Add(10 * time.Millisecond)
+	for i := 0; i < 1<<BitLenSequence; i++ {
+		if _, err := sf.NextID(); err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+	}
+	if _, err := sf.NextID(); err != ErrSequenceExhausted {
+		t.Errorf("unexpected error: %v", err)
+	}
+	if ids, err := sf.NextIDs(1); err != ErrSequenceExhausted || len(ids) != 0 {
+		t.Errorf("unexpected result of NextIDs: %d ids, %v", len(ids), err)
+	}
+	if sf.Elapsed() != 10 || sf.Sequence() != 1<<BitLenSequence-1 {
+		t.Errorf("unexpected state: %d, %d", sf.Elapsed(), sf.Sequence())
+	}
+
+	clock.Add(time.Millisecond)
+	id, err := sf.NextID()
+	if err != nil {
+		t.Fatalf("unexpected error after the clock advanced: %v", err)
+	}
+	if parts := DecomposeParts(id); parts.Time != 11 || parts.Sequence != 0 {
+		t.Errorf("unexpected parts: %+v", parts)
+	}
+}
+
+func TestReserve(t *testing.T) {
+	sf, clock := newFakeClockSnooflake(t)
+	clock.Add(10 * time.Millisecond)
+
+	ids, err := sf.Reserve(100)
+	if err != nil || len(ids) != 100 {
+		t.Fatalf("unexpected reservation: %d, %v", len(ids), err)
+	}
+	for i, id := range ids {
+		if parts := DecomposeParts(id); parts.Time != 10 || parts.Sequence != uint64(i) {
+			t.Errorf("unexpected parts: %+v", parts)
+		}
+	}
+
+	// The rest of the time unit is reserved, and then the next time unit is borrowed.
+	more, err := sf.Reserve(300)
+	if err != nil || len(more) != 300 {
+		t.Fatalf("unexpected reservation: %d, %v", len(more), err)
+	}
+	for i, id := range append(ids, more...) {
+		expected := Parts{ID: id, Time: 10 + uint64(i/256), Sequence: uint64(i % 256), MachineID: 1}
+		if parts := DecomposeParts(id); parts != expected {
+			t.Errorf("unexpected parts: %+v", parts)
+		}
+	}
+}
+
+func TestTimeUntilExhausted(t *testing.T) {
+	sf, clock := newFakeClockSnooflake(t)
+
+	lifetime := (1 << BitLenTime) * time.Millisecond
+	if actual := MaxTime(sf.StartTime(), 0); !actual.Equal(sf.StartTime().Add(lifetime)) {
+		t.Errorf("unexpected max time: %v", actual)
+	}
+	if actual := sf.TimeUntilExhausted(); actual != lifetime {
+		t.Errorf("unexpected time until exhausted: %v", actual)
+	}
+
+	clock.Add(lifetime - time.Hour)
+	if actual := sf.TimeUntilExhausted(); actual != time.Hour {
+		t.Errorf("unexpected time until exhausted: %v", actual)
+	}
+
+	clock.Add(2 * time.Hour)
+	if actual := sf.TimeUntilExhausted(); actual != 0 {
+		t.Errorf("unexpected time until exhausted: %v", actual)
+	}
+
+	// 1<<BitLenTime hours overflow time.Duration.
+	start := time.Date(2020, 1, 1, 0, 0, 0, 0, time.UTC)
+	expected := start.AddDate(0, 0, (1<<BitLenTime)/24).Add((1 << BitLenTime) % 24 * time.Hour)
+	if actual := MaxTime(start, time.Hour); !actual.Equal(expected) {
+		t.Errorf("unexpected max time: %v", actual)
+	}
+}
+
+func TestTimeFromElapsed(t *testing.T) {
+	start := time.Date(2020, 1, 2, 3, 4, 5, 0, time.FixedZone("JST", 9*60*60))
+	actual := TimeFromElapsed(start, 1234, 0)
+	if !actual.Equal(start.Add(1234*time.Millisecond)) || actual.Location() != time.UTC {
+		t.Errorf("unexpected time: %v", actual)
+	}
+	if actual := TimeFromElapsed(start, 3, 10*time.Millisecond); !actual.Equal(start.Add(30 * time.Millisecond)) {
+		t.Errorf("unexpected time: %v", actual)
+	}
+
+	unit := 10 * time.Millisecond
+	startTime := toSnooflakeTime(start, int64(unit))
+	for _, elapsed := range []int64{0, 1, 1234, 1 << BitLenTime} {
+		tm := timeFromElapsed(startTime, elapsed, unit)
+		if !tm.Equal(TimeFromElapsed(start, uint64(elapsed), unit)) {
+			t.Errorf("inconsistent time for %d: %v", elapsed, tm)
+		}
+		if actual := elapsedFromTime(startTime, tm.Add(unit-1), unit); actual != elapsed {
+			t.Errorf("unexpected round trip of %d: %d", elapsed, actual)
+		}
+	}
+}
+
+func benchmarkConcurrently(b *testing.B, numGoroutine int, nextID func() (uint64, error)) {
+	var wg sync.WaitGroup
+	b.ResetTimer()
+	for g := 0; g < numGoroutine; g++ {
+		wg.Add(1)
+		go func(n int) {
+			defer wg.Done()
+			for i := 0; i < n; i++ {
+				if _, err := nextID(); err != nil {
+					b.Error(err)
+					return
+				}
+			}
+		}((b.N + numGoroutine - 1) / numGoroutine)
+	}
+	wg.Wait()
+}
+
+func TestMachineIDHeartbeat(t *testing.T) {
+	var calls int32
+	var st Settings
+	st.MachineID = func() (uint16, error) { return 1, nil }
+	st.MachineIDHeartbeat = func(machineID uint16) error {
+		if machineID != 1 {
+			t.Errorf("unexpected machine id: %d", machineID)
+		}
+		if atomic.AddInt32(&calls, 1) < 3 {
+			return nil
+		}
+		return errors.New("lease taken")
+	}
+	st.MachineIDHeartbeatInterval = time.Millisecond
+	sf := NewSnooflake(st)
+	defer sf.Close()
+
+	deadline := time.Now().Add(10 * time.Second)
+	for {
+		_, err := sf.NextID()
+		if err == ErrMachineIDConflict {
+			break
+		}
+		if err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+		if time.Now().After(deadline) {
+			t.Fatal("conflict not detected")
+		}
+		time.Sleep(time.Millisecond)
+	}
+
+	if _, err := sf.NextIDs(10); err != ErrMachineIDConflict {
+		t.Errorf("unexpected error: %v", err)
+	}
+	if _, err := sf.NextIDAt(time.Now()); err != ErrMachineIDConflict {
+		t.Errorf("unexpected error: %v", err)
+	}
+	if n := atomic.LoadInt32(&calls); n != 3 {
+		t.Errorf("unexpected number of heartbeats: %d", n)
+	}
+}
+
+func TestInvalidHeartbeatInterval(t *testing.T) {
+	var st Settings
+	st.MachineID = func() (uint16, error) { return 1, nil }
+	st.MachineIDHeartbeat = func(uint16) error { return nil }
+	st.MachineIDHeartbeatInterval = -time.Second
+	if _, err := NewSnooflakeWithError(st); err != ErrInvalidInterval {
+		t.Errorf("unexpected error: %v", err)
+	}
+}
+
+func TestCloseHeartbeat(t *testing.T) {
+	var calls int32
+	var st Settings
+	st.MachineID = func() (uint16, error) { return 1, nil }
+	st.MachineIDHeartbeat = func(uint16) error {
+		atomic.AddInt32(&calls, 1)
+		return nil
+	}
+	st.MachineIDHeartbeatInterval = time.Millisecond
+	sf := NewSnooflake(st)
+
+	time.Sleep(10 * time.Millisecond)
+	if err := sf.Close(); err != nil {
+		t.Errorf("unexpected error: %v", err)
+	}
+	n := atomic.LoadInt32(&calls)
+	time.Sleep(10 * time.Millisecond)
+	if atomic.LoadInt32(&calls) != n {
+		t.Error("heartbeat not stopped")
+	}
+
+	if err := sf.Close(); err != nil {
+		t.Errorf("unexpected error on second close: %v", err)
+	}
+	if _, err := sf.NextID(); err != ErrClosed {
+		t.Errorf("unexpected error: %v", err)
+	}
+}
+
+func TestClose(t *testing.T) {
+	sf, clock := newFakeClockSnooflake(t)
+	ch := sf.Stream(context.Background(), 0)
+	<-ch
+
+	if err := sf.Close(); err != nil {
+		t.Errorf("unexpected error: %v", err)
+	}
+	for range ch {
+	}
+
+	if _, err := sf.NextID(); err != ErrClosed {
+		t.Errorf("unexpected error: %v", err)
+	}
+	if ids, err := sf.NextIDs(10); err != ErrClosed || len(ids) != 0 {
+		t.Errorf("unexpected result: %v, %v", ids, err)
+	}
+	if ids, err := sf.Reserve(10); err != ErrClosed || len(ids) != 0 {
+		t.Errorf("unexpected result of Reserve: %v, %v", ids, err)
+	}
+	if _, err := sf.NextIDAt(clock.Now()); err != ErrClosed {
+		t.Errorf("unexpected error of NextIDAt: %v", err)
+	}
+}
+
+// newBenchmarkSnooflake returns a Snooflake with a 16-bit sequence
+// so that benchmarks are not dominated by sleeping on sequence exhaustion.
+func newBenchmarkSnooflake() *Snooflake {
+	var st Settings
+	st.BitLenSequence = 16
+	st.BitLenMachineID = 8
+	st.MachineID = func() (uint16, error) { return 1, nil }
+	return NewSnooflake(st)
+}
+
+func BenchmarkNextID(b *testing.B) {
+	sf := newBenchmarkSnooflake()
+	for i := 0; i < b.N; i++ {
+		sf.NextID()
+	}
+}
+
+func BenchmarkNextIDParallel(b *testing.B) {
+	sf := newBenchmarkSnooflake()
+	b.RunParallel(func(pb *testing.PB) {
+		for pb.Next() {
+			sf.NextID()
+		}
+	})
+}
+
+func BenchmarkNextIDs(b *testing.B) {
+	for _, num := range []int{1, 16, 256, 4096} {
+		b.Run(fmt.Sprint(num), func(b *testing.B) {
+			sf := newBenchmarkSnooflake()
+			for i := 0; i < b.N; i++ {
+				sf.NextIDs(num)
+			}
+		})
+		b.Run(fmt.Sprintf("%d/parallel", num), func(b *testing.B) {
+			sf := newBenchmarkSnooflake()
+			b.RunParallel(func(pb *testing.PB) {
+				for pb.Next() {
+					sf.NextIDs(num)
+				}
+			})
+		})
+	}
+}
+
+func BenchmarkDecompose(b *testing.B) {
+	id := uint64(0x0123456789abcdef)
+	for i := 0; i < b.N; i++ {
+		Decompose(id)
+	}
+}
+
+func BenchmarkDecomposeParallel(b *testing.B) {
+	id := uint64(0x0123456789abcdef)
+	b.RunParallel(func(pb *testing.PB) {
+		for pb.Next() {
+			Decompose(id)
+		}
+	})
+}
+
+// BenchmarkNextIDConcurrency compares the lock-free NextID with NextID serialized by a mutex.
+func BenchmarkNextIDConcurrency(b *testing.B) {
+	for _, numGoroutine := range []int{1, 8, 64} {
+		b.Run(fmt.Sprintf("atomic/%d", numGoroutine), func(b *testing.B) {
+			sf := newBenchmarkSnooflake()
+			benchmarkConcurrently(b, numGoroutine, sf.NextID)
+		})
+		b.Run(fmt.Sprintf("mutex/%d", numGoroutine), func(b *testing.B) {
+			sf := newBenchmarkSnooflake()
+			var mutex sync.Mutex
+			benchmarkConcurrently(b, numGoroutine, func() (uint64, error) {
+				mutex.Lock()
+				defer mutex.Unlock()
+				return sf.NextID()
+			})
+		})
+	}
+}
+
+func pseudoSleep(period time.Duration) {
+	sf.startTime -= int64(period) / sf.timeUnit
+}
+
+func TestNextTypedID(t *testing.T) {
+	sf, _ := newFakeClockSnooflake(t)
+
+	last, err := sf.NextID()
+	if err != nil {
+		t.Fatal("id not generated")
+	}
+	id, err := sf.NextTypedID()
+	if err != nil {
+		t.Fatal("id not generated")
+	}
+	if uint64(id) <= last || id.MachineID() != 1 || id.Sequence() != DecomposeParts(last).Sequence+1 {
+		t.Errorf("unexpected id: %s", id.Describe())
+	}
+
+	sf.Close()
+	if _, err := sf.NextTypedID(); err != ErrClosed {
+		t.Errorf("unexpected error: %v", err)
+	}
 }
 
 func TestNextIDError(t *testing.T) {
 	year := time.Duration(365*24) * time.Hour
-	pseudoSleep(time.Duration(174) * year)
+	pseudoSleep(time.Duration(17) * year)
 	nextID(t)
 
 	pseudoSleep(time.Duration(1) * year)
 	_, err := sf.NextID()
-	if err == nil {
+	if !errors.Is(err, ErrOverTimeLimit) {
 		t.Errorf("time is not over")
 	}
 }
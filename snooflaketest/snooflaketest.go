@@ -0,0 +1,68 @@
+// Package snooflaketest provides utilities for testing Snooflake settings under a workload.
+package snooflaketest
+
+import (
+	"errors"
+	"fmt"
+	"sync"
+
+	"github.com/stringsinc/snooflake"
+)
+
+// ErrDuplicateID is returned by CheckUnique when a Snooflake generates the same ID twice.
+var ErrDuplicateID = errors.New("duplicate id")
+
+// CheckUnique generates n IDs with sf from the given number of goroutines,
+// e.g. in the CI of a service to validate its Settings,
+// and returns ErrDuplicateID, wrapped with the ID, if any ID is generated twice.
+// The goroutines share the IDs as evenly as possible.
+// It returns the error of NextID, wrapped, if an ID is not generated,
+// and an error if n is negative or concurrency is less than 1.
+// CheckUnique keeps all the IDs in memory to find the duplicates.
+func CheckUnique(sf *snooflake.Snooflake, n int, concurrency int) error {
+	if n < 0 || concurrency < 1 {
+		return fmt.Errorf("invalid number of ids %d or goroutines %d", n, concurrency)
+	}
+
+	ids := make([][]uint64, concurrency)
+	errs := make([]error, concurrency)
+	var wg sync.WaitGroup
+	for i := 0; i < concurrency; i++ {
+		num := n / concurrency
+		if i < n%concurrency {
+			num++
+		}
+
+		wg.Add(1)
+		go func(i, num int) {
+			defer wg.Done()
+			ids[i] = make([]uint64, 0, num)
+			for len(ids[i]) < num {
+				id, err := sf.NextID()
+				if err != nil {
+					errs[i] = fmt.Errorf("next id: %w", err)
+					return
+				}
+				ids[i] = append(ids[i], id)
+			}
+		}(i, num)
+	}
+	wg.Wait()
+
+	for _, err := range errs {
+		if err != nil {
+			return err
+		}
+	}
+
+	seen := make(map[uint64]struct{}, n)
+	for _, s := range ids {
+		for _, id := range s {
+			if _, ok := seen[id]; ok {
+				return fmt.Errorf("%w: %d", ErrDuplicateID, id)
+			}
+			seen[id] = struct{}{}
+		}
+	}
+	return nil
+}
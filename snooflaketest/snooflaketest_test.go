@@ -0,0 +1,56 @@
+package snooflaketest
+
+import (
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/stringsinc/snooflake"
+)
+
+func TestCheckUnique(t *testing.T) {
+	var st snooflake.Settings
+	st.MachineID = func() (uint16, error) { return 1, nil }
+	sf := snooflake.NewSnooflake(st)
+
+	for _, concurrency := range []int{1, 3, 16} {
+		if err := CheckUnique(sf, 10000, concurrency); err != nil {
+			t.Errorf("unexpected error with %d goroutines: %v", concurrency, err)
+		}
+	}
+
+	if err := CheckUnique(sf, 0, 1); err != nil {
+		t.Errorf("unexpected error for no ids: %v", err)
+	}
+	if err := CheckUnique(sf, -1, 1); err == nil {
+		t.Error("no error for negative number of ids")
+	}
+	if err := CheckUnique(sf, 1, 0); err == nil {
+		t.Error("no error without goroutines")
+	}
+
+	sf.Close()
+	if err := CheckUnique(sf, 1, 1); !errors.Is(err, snooflake.ErrClosed) {
+		t.Errorf("unexpected error after close: %v", err)
+	}
+}
+
+func TestCheckUniqueDuplicate(t *testing.T) {
+	// With OverflowRecycle, a clock jumping by a whole epoch on every reading
+	// makes the time part of the IDs repeat, and so the IDs.
+	epoch := time.Duration(1<<snooflake.BitLenTime) * time.Millisecond
+	now := time.Date(2020, 1, 1, 0, 0, 0, 0, time.UTC)
+	var st snooflake.Settings
+	st.StartTime = now
+	st.OnOverflow = snooflake.OverflowRecycle
+	st.NowFunc = func() time.Time {
+		now = now.Add(epoch)
+		return now
+	}
+	st.MachineID = func() (uint16, error) { return 1, nil }
+	sf := snooflake.NewSnooflake(st)
+
+	if err := CheckUnique(sf, 2, 1); !errors.Is(err, ErrDuplicateID) {
+		t.Errorf("unexpected error: %v", err)
+	}
+}
@@ -0,0 +1,59 @@
+package snooflake
+
+import "sync/atomic"
+
+// State is the Snooflake time and the sequence number of the last ID generated by a Snooflake.
+// A process can persist it on shutdown and restore it by NewFromState on restart,
+// so that the IDs after the restart never sort before the IDs before it,
+// even if the clock moved backwards in between.
+// Elapsed is not wrapped around with Settings.OnOverflow OverflowRecycle, unlike Snooflake.Elapsed.
+type State struct {
+	Elapsed  int64
+	Sequence uint16
+}
+
+// State returns the state of sf to be restored by NewFromState.
+// It is safe to call concurrently with NextID, but the IDs generated afterwards advance the state further,
+// so it should be called after the last ID is generated, e.g. after Close.
+func (sf *Snooflake) State() State {
+	elapsedTime, sequence := unpackState(atomic.LoadUint64(&sf.state))
+	return State{Elapsed: elapsedTime, Sequence: sequence}
+}
+
+// NewFromState is like NewSnooflakeWithError but resumes from the given State
+// returned by Snooflake.State of a previous Snooflake with the same Settings.
+// If the state is older than the clock, it has no effect since NextID starts from the clock anyway.
+// If it is newer, NextID waits for the clock to catch up with it as with a clock moved backwards,
+// or returns ErrClockMovedBackwards beyond Settings.ClockBackwardThreshold,
+// taking state.Elapsed as the latest reading of the clock.
+// NewFromState returns ErrOverTimeLimit if state.Elapsed is negative or overflows the time bits
+// unless Settings.OnOverflow is OverflowRecycle,
+// and ErrSequenceTooLarge if state.Sequence does not fit in the sequence bits.
+func NewFromState(st Settings, state State) (*Snooflake, error) {
+	sf, err := NewSnooflakeWithError(st)
+	if err != nil {
+		return nil, err
+	}
+
+	switch {
+	case state.Elapsed < 0 || sf.onOverflow != OverflowRecycle && state.Elapsed >= 1<<BitLenTime:
+		err = ErrOverTimeLimit
+	case int(state.Sequence) >= 1<<sf.bitLenSequence:
+		err = ErrSequenceTooLarge
+	}
+	if err != nil {
+		sf.Close()
+		return nil, err
+	}
+
+	if elapsedTime, _ := unpackState(sf.state); state.Elapsed > elapsedTime {
+		sf.state = packState(state.Elapsed, state.Sequence)
+		sf.clockHigh = state.Elapsed
+		if sf.randomizeSequence {
+			// The new seed offsets the sequence numbers differently from the previous Snooflake,
+			// so the rest of the time unit of the state may collide with its IDs.
+			sf.state = packState(state.Elapsed, uint16(1<<sf.bitLenSequence-1))
+		}
+	}
+	return sf, nil
+}
@@ -0,0 +1,93 @@
+package snooflake
+
+import (
+	"testing"
+	"time"
+)
+
+func TestNewFromState(t *testing.T) {
+	sf, clock := newFakeClockSnooflake(t)
+	clock.Add(10 * time.Millisecond)
+	last, err := sf.NextID()
+	if err != nil {
+		t.Fatal("id not generated")
+	}
+	state := sf.State()
+	if state != (State{Elapsed: 10, Sequence: 0}) {
+		t.Errorf("unexpected state: %+v", state)
+	}
+
+	// Restart with the clock moved backwards.
+	clock.Add(-5 * time.Millisecond)
+	var st Settings
+	st.StartTime = time.Date(2020, 1, 1, 0, 0, 0, 0, time.UTC)
+	st.NowFunc = clock.Now
+	st.Sleeper = func(d time.Duration) { clock.Add(d) }
+	st.MachineID = func() (uint16, error) { return 1, nil }
+	restored, err := NewFromState(st, state)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if restored.State() != state {
+		t.Errorf("unexpected restored state: %+v", restored.State())
+	}
+	id, err := restored.NextID()
+	if err != nil {
+		t.Fatal("id not generated")
+	}
+	if id <= last {
+		t.Errorf("id after restart not ascending: %d <= %d", id, last)
+	}
+
+	// An older state has no effect.
+	restored, err = NewFromState(st, State{Elapsed: 1, Sequence: 3})
+	if err != nil {
+		t.Fatal(err)
+	}
+	id, err = restored.NextID()
+	if err != nil {
+		t.Fatal("id not generated")
+	}
+	if parts := DecomposeParts(id); parts.Time != 10 || parts.Sequence != 0 {
+		t.Errorf("unexpected parts: %+v", parts)
+	}
+
+	// With randomized sequence numbers, the rest of the time unit of the state is skipped.
+	st.RandomizeSequenceStart = true
+	restored, err = NewFromState(st, State{Elapsed: 20, Sequence: 3})
+	if err != nil {
+		t.Fatal(err)
+	}
+	id, err = restored.NextID()
+	if err != nil {
+		t.Fatal("id not generated")
+	}
+	if parts := DecomposeParts(id); parts.Time != 21 {
+		t.Errorf("unexpected parts: %+v", parts)
+	}
+}
+
+func TestNewFromStateError(t *testing.T) {
+	var st Settings
+	st.MachineID = func() (uint16, error) { return 1, nil }
+
+	invalid := []struct {
+		state State
+		err   error
+	}{
+		{State{Elapsed: -1}, ErrOverTimeLimit},
+		{State{Elapsed: 1 << BitLenTime}, ErrOverTimeLimit},
+		{State{Sequence: 1 << BitLenSequence}, ErrSequenceTooLarge},
+	}
+	for _, tc := range invalid {
+		if _, err := NewFromState(st, tc.state); err != tc.err {
+			t.Errorf("unexpected error for %+v: %v", tc.state, err)
+		}
+	}
+
+	st.BitLenSequence = 16
+	st.BitLenMachineID = 8
+	if _, err := NewFromState(st, State{Sequence: 1<<16 - 1}); err != nil {
+		t.Errorf("unexpected error for 16-bit sequence: %v", err)
+	}
+}
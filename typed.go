@@ -0,0 +1,68 @@
+package snooflake
+
+import "database/sql/driver"
+
+// Typed is an ID of the entity type T, e.g. to tell a user ID from an order ID at compile time.
+// Typed IDs of different entity types are not assignable to each other, although all of them
+// are generated by the same Generator and encoded like ID.
+// T is a phantom type that only distinguishes the ID types, so an empty struct is enough.
+// The recommended pattern is an alias for each entity:
+//
+//	type User struct{ ID UserID }
+//	type UserID = snooflake.Typed[User]
+//
+//	id, err := snooflake.NextTyped[User](sf)
+//
+// An alias keeps the methods of Typed, which a type definition such as "type UserID snooflake.Typed[User]" would drop.
+type Typed[T any] uint64
+
+// NextTyped generates a next unique ID of the entity type T by g.
+func NextTyped[T any](g Generator) (Typed[T], error) {
+	id, err := g.NextID()
+	return Typed[T](id), err
+}
+
+// ID returns id as an untyped ID, e.g. to decompose it.
+func (id Typed[T]) ID() ID {
+	return ID(id)
+}
+
+// IsZero reports whether id is the zero value.
+func (id Typed[T]) IsZero() bool {
+	return id == 0
+}
+
+// String returns id in decimal as ID.String.
+func (id Typed[T]) String() string {
+	return ID(id).String()
+}
+
+// Value implements driver.Valuer as ID.Value.
+func (id Typed[T]) Value() (driver.Value, error) {
+	return ID(id).Value()
+}
+
+// Scan implements sql.Scanner as ID.Scan.
+func (id *Typed[T]) Scan(src interface{}) error {
+	return (*ID)(id).Scan(src)
+}
+
+// MarshalJSON implements json.Marshaler as ID.MarshalJSON.
+func (id Typed[T]) MarshalJSON() ([]byte, error) {
+	return ID(id).MarshalJSON()
+}
+
+// UnmarshalJSON implements json.Unmarshaler as ID.UnmarshalJSON.
+func (id *Typed[T]) UnmarshalJSON(data []byte) error {
+	return (*ID)(id).UnmarshalJSON(data)
+}
+
+// MarshalText implements encoding.TextMarshaler as ID.MarshalText.
+func (id Typed[T]) MarshalText() ([]byte, error) {
+	return ID(id).MarshalText()
+}
+
+// UnmarshalText implements encoding.TextUnmarshaler as ID.UnmarshalText.
+func (id *Typed[T]) UnmarshalText(text []byte) error {
+	return (*ID)(id).UnmarshalText(text)
+}
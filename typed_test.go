@@ -0,0 +1,64 @@
+package snooflake
+
+import (
+	"database/sql"
+	"database/sql/driver"
+	"encoding"
+	"encoding/json"
+	"fmt"
+	"reflect"
+	"testing"
+)
+
+type testUser struct{}
+
+type testOrder struct{}
+
+type testUserID = Typed[testUser]
+
+func TestTyped(t *testing.T) {
+	var _ fmt.Stringer = testUserID(0)
+	var _ json.Marshaler = testUserID(0)
+	var _ json.Unmarshaler = (*testUserID)(nil)
+	var _ encoding.TextMarshaler = testUserID(0)
+	var _ encoding.TextUnmarshaler = (*testUserID)(nil)
+	var _ sql.Scanner = (*testUserID)(nil)
+	var _ driver.Valuer = testUserID(0)
+
+	if reflect.TypeOf(testUserID(0)) == reflect.TypeOf(Typed[testOrder](0)) {
+		t.Error("typed ids of different entities have the same type")
+	}
+
+	sf, _ := newFakeClockSnooflake(t)
+	id, err := NextTyped[testUser](sf)
+	if err != nil {
+		t.Fatal("id not generated")
+	}
+	if id.IsZero() || id.ID().MachineID() != 1 || id.String() != id.ID().String() {
+		t.Errorf("unexpected id: %s", id.ID().Describe())
+	}
+
+	type user struct {
+		ID testUserID `json:"id"`
+	}
+	b, err := json.Marshal(user{ID: id})
+	if err != nil || string(b) != `{"id":"`+id.String()+`"}` {
+		t.Errorf("unexpected json: %s, %v", b, err)
+	}
+	var decoded user
+	if err := json.Unmarshal(b, &decoded); err != nil || decoded.ID != id {
+		t.Errorf("unexpected round trip: %d, %v", decoded.ID, err)
+	}
+
+	v, err := id.Value()
+	if err != nil {
+		t.Fatal(err)
+	}
+	var scanned testUserID
+	if err := scanned.Scan(v); err != nil || scanned != id {
+		t.Errorf("unexpected scan: %d, %v", scanned, err)
+	}
+	if err := scanned.UnmarshalText([]byte("abc")); err == nil {
+		t.Error("id from abc")
+	}
+}